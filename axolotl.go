@@ -1,13 +1,14 @@
 package axolotl
 
 import (
-	"container/list"
 	"crypto/cipher"
-	"crypto/rand"
 	"errors"
 	"github.com/arcpop/ecdh"
 	"hash"
 	"io"
+	"strconv"
+	"sync"
+	"time"
 )
 
 //Specifies which elliptic curve is used for ECDH
@@ -16,6 +17,10 @@ const (
 	CurveP256 = iota
 	CurveP384 = iota
 	CurveP521 = iota
+	//CurveX25519 selects X25519 as specified in RFC 7748
+	CurveX25519 = iota
+	//CurveX448 selects X448 as specified in RFC 7748
+	CurveX448 = iota
 )
 
 //Specifies which stream cipher is used for symmetric en-/decryption
@@ -23,35 +28,254 @@ const (
 	AES_GCM_128 = iota
 	AES_GCM_192 = iota
 	AES_GCM_256 = iota
+	//CHACHA20_POLY1305 selects ChaCha20-Poly1305 as specified in RFC 8439
+	CHACHA20_POLY1305 = iota
+	//XCHACHA20_POLY1305 selects ChaCha20-Poly1305 with the extended 24 byte nonce
+	XCHACHA20_POLY1305 = iota
 )
 
 //Specifies which hashed key derivation function is used to generate the keystream
 const (
-	HKDF_SHA_256  = iota
-	HKDF_SHA_384  = iota
+	HKDF_SHA_256 = iota
+	HKDF_SHA_384 = iota
+	//HKDF_SHA_512 runs SHA-512. Releases before the versioned wire format ran SHA-256 for this id,
+	//their messages are rejected with ErrUnknownSuite and their states are loaded with HKDF_SHA_512_COMPAT.
 	HKDF_SHA_512  = iota
 	HKDF_SHA3_256 = iota
 	HKDF_SHA3_384 = iota
 	HKDF_SHA3_512 = iota
+	//HKDF_SHA_512_COMPAT selects the HKDF with SHA-256 earlier releases ran for HKDF_SHA_512
+	HKDF_SHA_512_COMPAT = iota
 )
 
 //Specified which hash function is used for HMAC
 const (
-	HMAC_SHA_256  = iota
-	HMAC_SHA_384  = iota
+	HMAC_SHA_256 = iota
+	HMAC_SHA_384 = iota
+	//HMAC_SHA_512 runs SHA-512. Releases before the versioned wire format ran SHA-256 for this id,
+	//their messages are rejected with ErrUnknownSuite and their states are loaded with HMAC_SHA_512_COMPAT.
 	HMAC_SHA_512  = iota
 	HMAC_SHA3_256 = iota
 	HMAC_SHA3_384 = iota
 	HMAC_SHA3_512 = iota
+	//HMAC_SHA_512_COMPAT selects the HMAC with SHA-256 earlier releases ran for HMAC_SHA_512
+	HMAC_SHA_512_COMPAT = iota
+)
+
+//Specifies which key encapsulation mechanism is used for post-quantum key agreement
+const (
+	ML_KEM_768  = iota
+	ML_KEM_1024 = iota
 )
 
 //ErrInvalidKeyLength gets returned if a function expecting a key gets a key which is too short
 var ErrInvalidKeyLength = errors.New("The specified key has not sufficient length.")
 
+//ErrInvalidPublicKey gets returned if a DH public key is not a valid point on the curve
+var ErrInvalidPublicKey = errors.New("The specified public key is invalid.")
+
+//ErrUnknownAlgorithm gets returned if an algorithm id or name is not registered
+var ErrUnknownAlgorithm = errors.New("The specified algorithm is not supported.")
+
+//ErrUnknownCurve is ErrUnknownAlgorithm, curves are registered like all other algorithms
+//
+//Deprecated: use ErrUnknownAlgorithm.
+var ErrUnknownCurve = ErrUnknownAlgorithm
+
+//ErrUnknownSuite gets returned if a suite id or name is not registered
+var ErrUnknownSuite = errors.New("The specified suite is not supported.")
+
+//ErrAlgorithmRegistered gets returned if an algorithm id or name is registered twice
+var ErrAlgorithmRegistered = errors.New("The specified algorithm id or name is already registered.")
+
+//ErrInvalidAlgorithm gets returned if an algorithm is registered without a name or implementation
+var ErrInvalidAlgorithm = errors.New("The specified algorithm is invalid.")
+
+//ErrCurveMismatch gets returned if the keys of a handshake use different curves
+var ErrCurveMismatch = errors.New("The specified keys use different curves.")
+
+//ErrInvalidSignature gets returned if the signature of a signed prekey does not verify
+var ErrInvalidSignature = errors.New("The signature of the signed prekey is invalid.")
+
+//ErrUnknownPreKey gets returned if a handshake references a prekey which was not supplied
+var ErrUnknownPreKey = errors.New("The handshake references an unknown prekey.")
+
+//ErrUnknownKEM gets returned if the KEM parameter does not name a supported key encapsulation mechanism
+var ErrUnknownKEM = errors.New("The specified key encapsulation mechanism is not supported.")
+
+//ErrMissingPQPreKey gets returned if a post-quantum handshake lacks the post-quantum prekey or ciphertext
+var ErrMissingPQPreKey = errors.New("The handshake lacks the post-quantum prekey.")
+
+//ErrUnsupportedVersion gets returned if a message uses a wire format version or flags this package does not understand
+var ErrUnsupportedVersion = errors.New("The passed message uses an unsupported format version.")
+
+//ErrTooManySkipped gets returned if a message would skip more message keys than the limits allow
+var ErrTooManySkipped = errors.New("The passed message skips too many messages.")
+
+//ErrInvalidState gets returned if a saved state cannot be authenticated
+var ErrInvalidState = errors.New("The passed state is malformed or has been tampered with.")
+
+//ErrLegacySkippedKeys gets returned if a state in the legacy layout holds skipped message
+//keys, they were saved without their message numbers and cannot be migrated
+var ErrLegacySkippedKeys = errors.New("The legacy state holds skipped message keys which cannot be migrated.")
+
+//ErrSessionNotFound gets returned if a SessionStore holds no session for the address
+var ErrSessionNotFound = errors.New("The specified session does not exist.")
+
+//ErrInvalidLimits gets returned if a state is saved with limits which are negative or too large to be stored
+var ErrInvalidLimits = errors.New("The limits of the state are out of range.")
+
+//ErrInvalidStore gets returned if a nil store is passed
+var ErrInvalidStore = errors.New("The specified store is invalid.")
+
+//ErrSkippedKeysNotMoved gets returned if the skipped keys held by a store other than the in-memory store would be left behind
+var ErrSkippedKeysNotMoved = errors.New("The skipped keys of the current store cannot be moved.")
+
+//ErrTruncatedStream gets returned if a stream ends before its final chunk
+var ErrTruncatedStream = errors.New("The passed stream has been truncated.")
+
+//ErrStreamTooLong gets returned if a stream has more chunks than the chunk counter can number
+var ErrStreamTooLong = errors.New("The passed stream is too long.")
+
+//ErrMessageTooLarge is wrapped by MessageTooLargeError
+var ErrMessageTooLarge = errors.New("The passed message exceeds the size limits.")
+
+//MessageTooLargeError gets returned if the header or body of a received message is
+//longer than allowed by the Limits of the state. It is returned before anything
+//of that size is allocated or read.
+type MessageTooLargeError struct {
+	//Part is "header" or "message"
+	Part   string
+	Length uint32
+	Limit  uint32
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return "The " + e.Part + " of the passed message has " + strconv.FormatUint(uint64(e.Length), 10) +
+		" bytes, at most " + strconv.FormatUint(uint64(e.Limit), 10) + " bytes are allowed."
+}
+
+//Unwrap returns ErrMessageTooLarge
+func (e *MessageTooLargeError) Unwrap() error {
+	return ErrMessageTooLarge
+}
+
+//ErrInvalidKeyPair gets returned if a DH key pair is missing or does not belong to the curve
+var ErrInvalidKeyPair = errors.New("The specified key pair is invalid.")
+
+//ErrInvalidOption is wrapped by a ConfigError if an option has an invalid value
+var ErrInvalidOption = errors.New("The specified option has an invalid value.")
+
+//ErrMissingOption is wrapped by a ConfigError if a required option is missing
+var ErrMissingOption = errors.New("A required option is missing.")
+
+//ConfigError gets returned by New if an option is invalid or missing
+type ConfigError struct {
+	//Option names the offending option, e.g. "master key"
+	Option string
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	return "Option " + e.Option + ": " + e.Err.Error()
+}
+
+//Unwrap returns the reason the option was rejected
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+//ErrMalformedMessage gets returned if a message cannot be parsed
 var ErrMalformedMessage = errors.New("The passed message seem to be malformed.")
 
+//ErrUndecryptable matches every *DecryptError with errors.Is
 var ErrUndecryptable = errors.New("The passed message cannot be decrypted.")
 
+//ErrHeaderAuthentication gets returned if none of the header keys of the state
+//authenticates the header. The message is forged, corrupted, belongs to another
+//session or to a chain whose keys the state has already dropped.
+var ErrHeaderAuthentication = errors.New("The header of the passed message cannot be authenticated.")
+
+//ErrBodyAuthentication gets returned if the header is authentic but the body is not
+var ErrBodyAuthentication = errors.New("The body of the passed message cannot be authenticated.")
+
+//ErrDuplicateMessage gets returned if the message has already been decrypted
+//Decrypted messages are remembered within Limits.ReplayWindow by digests of their
+//header and body. A copy of a remembered header with another body is reported
+//as ErrBodyAuthentication.
+var ErrDuplicateMessage = errors.New("The passed message has already been received.")
+
+//ErrExpiredMessage gets returned if the key of an authentic header is not held
+//anymore and the message is not known as a duplicate. Its skipped key has been
+//evicted or it is older than the replay window.
+var ErrExpiredMessage = errors.New("The key of the passed message has been dropped.")
+
+//ErrStaleSession gets returned if the message cannot be decrypted with the
+//chains of the state, e.g. because one side restored an older state. Only a new
+//handshake recovers the session.
+var ErrStaleSession = errors.New("The state of the session is out of sync with the peer.")
+
+//DecryptError gets returned if a received message cannot be decrypted
+//Err is ErrMalformedMessage, ErrUnsupportedVersion, a *MessageTooLargeError,
+//ErrUnknownSuite, ErrHeaderAuthentication, ErrBodyAuthentication,
+//ErrDuplicateMessage, ErrExpiredMessage, ErrTooManySkipped or ErrStaleSession,
+//for streams also ErrTruncatedStream or ErrStreamTooLong.
+//MessageNumber and RatchetKey, the DH public key of the sending chain, are only
+//set if the header could be decrypted. Errors reading the message or of the
+//SkippedKeyStore are not wrapped, a decryption failing with them may be retried.
+type DecryptError struct {
+	Err           error
+	MessageNumber uint32
+	RatchetKey    []byte
+}
+
+func (e *DecryptError) Error() string {
+	if e.RatchetKey == nil {
+		return e.Err.Error()
+	}
+	return e.Err.Error() + " (message " + strconv.FormatUint(uint64(e.MessageNumber), 10) + ")"
+}
+
+//Unwrap returns Err
+func (e *DecryptError) Unwrap() error {
+	return e.Err
+}
+
+//Is reports whether target is ErrUndecryptable
+func (e *DecryptError) Is(target error) bool {
+	return target == ErrUndecryptable
+}
+
+//Limits bounds the resources spent on received messages, a zero field means no limit
+type Limits struct {
+	//MaxSkip is the maximum number of message keys skipped within a single chain
+	MaxSkip uint32 `json:"max_skip"`
+	//MaxSkippedKeys is the maximum number of stored skipped message keys, the oldest ones get evicted first
+	MaxSkippedKeys int `json:"max_skipped_keys"`
+	//MaxSkippedAge evicts stored keys after they have been stored for this long, keys are
+	//evicted by the next successful decryption
+	MaxSkippedAge time.Duration `json:"max_skipped_age"`
+	//MaxSkippedRatchetSteps evicts stored keys after this many receiving DH ratchet steps
+	MaxSkippedRatchetSteps uint32 `json:"max_skipped_ratchet_steps"`
+	//MaxHeaderSize is the maximum length of the encrypted header of a received message
+	MaxHeaderSize uint32 `json:"max_header_size"`
+	//MaxMessageSize is the maximum length of the encrypted body of a received message
+	MaxMessageSize uint32 `json:"max_message_size"`
+	//ReplayWindow is the number of decrypted messages remembered to detect duplicates,
+	//only digests of the encrypted messages are kept
+	ReplayWindow int `json:"replay_window"`
+}
+
+//DefaultLimits are the limits of newly created and loaded states
+var DefaultLimits = Limits{
+	MaxSkip:                1000,
+	MaxSkippedKeys:         2000,
+	MaxSkippedRatchetSteps: 20,
+	MaxHeaderSize:          64 * 1024,
+	MaxMessageSize:         64 * 1024 * 1024,
+	ReplayWindow:           1000,
+}
+
 //State describes an axolotl protocol state
 type State struct {
 	CurveParam   uint8
@@ -62,7 +286,7 @@ type State struct {
 
 	rootKey key
 
-    headerNonceSource []byte
+	headerNonceSource []byte
 
 	hdrKeyS key
 	hdrKeyR key
@@ -83,56 +307,465 @@ type State struct {
 
 	ratchetFlag bool
 
-	skippedKeys *list.List
+	//Limits bounds the work and memory spent on skipped messages
+	Limits Limits
+
+	ratchetSteps uint32
 
-	stagedSkippedMKs []storedkey
+	skippedKeys SkippedKeyStore
+
+	//seen is the replay window, oldest chain first
+	seen []seenChain
+
+	pqRatchet      bool
+	pqKEM          uint8
+	pqInterval     uint32
+	pqSteps        uint32
+	pqDecapKey     []byte
+	pqPeerEncapKey []byte
+	pqHeader       []byte
 
 	hmac         func(key []byte) hash.Hash
 	hkdf         func(secret, salt, info []byte) io.Reader
 	streamCipher func(key []byte) (cipher.AEAD, error)
+	dh           dhCurve
+	kem          kemScheme
+	suiteID      uint16
+
+	//padding is the block size plaintexts are padded to, 0 disables padding
+	padding uint32
+
+	//random and clock are set by New, crypto/rand and time.Now are used if they are nil
+	random io.Reader
+	clock  func() time.Time
+
+	//rootLock guards the DH ratchet of a state shared by a Session, it is nil otherwise
+	rootLock sync.Locker
+}
+
+//Role selects the side of the session a state is created for by New
+type Role int
+
+const (
+	//RoleSender sends the first message, it needs WithPeerPublicKey
+	RoleSender Role = iota + 1
+	//RoleReceiver receives the first message, it needs WithKeyPair
+	RoleReceiver
+)
+
+//Option configures a state created by New
+type Option func(*options) error
+
+//New returns a new state for role configured by opts
+//WithMasterKey is required, a sender needs WithPeerPublicKey and a receiver WithKeyPair.
+//Without WithSuite SuiteX25519_SHA256_AESGCM256 is used. All options are validated,
+//a *ConfigError names the option which is invalid or missing.
+func New(role Role, opts ...Option) (*State, error) {
+	return axolotlNew(role, opts)
+}
+
+//WithSuite selects the algorithms of the state, all of them have to be registered
+func WithSuite(suite Suite) Option {
+	return withSuite(suite)
+}
+
+//WithMasterKey sets the secret shared by both parties, it must have at least 32 bytes
+func WithMasterKey(masterKey []byte) Option {
+	return withMasterKey(masterKey)
+}
+
+//WithPeerPublicKey sets the DH public key of the receiver, only for RoleSender
+func WithPeerPublicKey(publicKey []byte) Option {
+	return withPeerPublicKey(publicKey)
+}
+
+//WithKeyPair sets the DH key pair whose public key the sender got, only for RoleReceiver
+func WithKeyPair(keyPair *ecdh.ECDH) Option {
+	return withKeyPair(keyPair)
+}
+
+//WithRandom sets the source of randomness for key generation and nonces, see State.SetRandom
+func WithRandom(random io.Reader) Option {
+	return withRandom(random)
+}
+
+//WithLimits sets the non-zero fields of limits, the other limits keep their value
+//of DefaultLimits. To lift a limit set the field of State.Limits to zero.
+func WithLimits(limits Limits) Option {
+	return withLimits(limits)
+}
+
+//WithPadding pads every plaintext to a multiple of blockSize bytes before encryption
+//Padded messages are marked by a flag on the wire, so the receiver needs no option.
+func WithPadding(blockSize int) Option {
+	return withPadding(blockSize)
+}
+
+//WithClock sets the clock used to age skipped message keys, see State.SetClock
+func WithClock(clock func() time.Time) Option {
+	return withClock(clock)
 }
 
 //NewSender returns a new state to work with the axolotl protocol
+//It returns ErrUnknownAlgorithm if one of the algorithm ids is not registered
 func NewSender(curveParam, streamCipher, HKDF, HMAC uint8, masterKey, dhPubKey []byte) (*State, error) {
 	return axolotlNewS(curveParam, streamCipher, HKDF, HMAC, masterKey, dhPubKey)
 }
 
 //NewReceiver returns a new state to work with the axolotl protocol
+//For CurveX25519 and CurveX448 the ecdhParams have to be generated by GenerateKeyPair
+//It returns ErrUnknownAlgorithm if one of the algorithm ids is not registered
 func NewReceiver(curveParam, streamCipher, HKDF, HMAC uint8, masterKey []byte, ecdhParams *ecdh.ECDH) (*State, error) {
 	return axolotlNewR(curveParam, streamCipher, HKDF, HMAC, masterKey, ecdhParams)
 }
 
+//NewSenderWithSuite returns a new state using the algorithms of suite
+func NewSenderWithSuite(suite Suite, masterKey, dhPubKey []byte) (*State, error) {
+	return axolotlNewS(suite.Curve, suite.Cipher, suite.KDF, suite.MAC, masterKey, dhPubKey)
+}
+
+//NewReceiverWithSuite returns a new state using the algorithms of suite
+func NewReceiverWithSuite(suite Suite, masterKey []byte, ecdhParams *ecdh.ECDH) (*State, error) {
+	return axolotlNewR(suite.Curve, suite.Cipher, suite.KDF, suite.MAC, masterKey, ecdhParams)
+}
+
+//ParseSuite returns the suite registered under name, e.g. "X25519_SHA256_AESGCM256"
+func ParseSuite(name string) (Suite, error) {
+	return parseSuite(name)
+}
+
+//SuiteByID returns the suite registered under id
+func SuiteByID(id uint16) (Suite, error) {
+	return suiteByID(id)
+}
+
+//RegisterSuite registers a suite under its ID and Name, all of its algorithms have to be registered
+func RegisterSuite(suite Suite) error {
+	return registerSuite(suite)
+}
+
+//Suite returns the suite the state uses
+//If the algorithms do not match a registered suite the returned suite has ID 0 and no Name
+func (s *State) Suite() Suite {
+	return stateSuite(s)
+}
+
+//GenerateKeyPair generates a new DH key pair on the curve specified by curveParam
+//The public key is what the sender passes to NewSender, the key pair itself is passed to NewReceiver
+func GenerateKeyPair(curveParam uint8, randomData io.Reader) (*ecdh.ECDH, error) {
+	c, err := lookupCurve(curveParam)
+	if err != nil {
+		return nil, err
+	}
+	return c.generate(randomData)
+}
+
 //FromFile returns a previous saved state from file to work with the axolotl protocol
+//It returns ErrInvalidState if the checksum of the file does not match
 func FromFile(fileName string) (*State, error) {
 	return axolotlFromFile(fileName)
 }
 
+//MigrateLegacyState reads a state file in the unversioned layout of the first releases
+//Those files carry no checksum, so only files which match the layout exactly are
+//accepted. Save the returned state with SaveTo to convert the file.
+func MigrateLegacyState(fileName string) (*State, error) {
+	return axolotlMigrateLegacyState(fileName)
+}
+
 //SaveTo saves the current state into the file specified by fileName
+//The file is replaced atomically, after a crash it holds either the previous or the current state.
 func (s *State) SaveTo(fileName string) error {
 	return axolotlSaveTo(s, fileName)
 }
 
+//MarshalBinary returns the complete state including all keys, see encoding.BinaryMarshaler
+//The result is not encrypted, use SaveEncrypted to store it somewhere untrusted.
+func (s *State) MarshalBinary() ([]byte, error) {
+	return axolotlMarshalBinary(s)
+}
+
+//UnmarshalBinary replaces the state by the one encoded in data by MarshalBinary
+//The random source, the clock, the Session wrapping the state and a skipped key
+//store other than the memory store are kept.
+func (s *State) UnmarshalBinary(data []byte) error {
+	return axolotlUnmarshalBinary(s, data)
+}
+
+//WriteTo writes the state to w in the format of MarshalBinary, see io.WriterTo
+func (s *State) WriteTo(w io.Writer) (int64, error) {
+	return axolotlWriteTo(s, w)
+}
+
+//ReadState reads a state written by WriteTo, it reads no more than the state from rd
+func ReadState(rd io.Reader) (*State, error) {
+	return readState(rd)
+}
+
+//ExportJSON returns the JSON representation of the state for diagnosis and fixtures, see StateJSON
+//Unless includeSecrets is set all keys except public keys are left out and the result cannot be imported.
+func (s *State) ExportJSON(includeSecrets bool) ([]byte, error) {
+	return axolotlExportJSON(s, includeSecrets)
+}
+
+//ImportJSON returns the state exported by ExportJSON including its secrets
+//It returns ErrInvalidState if the export is redacted.
+func ImportJSON(data []byte) (*State, error) {
+	return axolotlImportJSON(data)
+}
+
+//SaveEncrypted writes the state to w encrypted and authenticated with XChaCha20-Poly1305 under the 32 byte key kek
+func (s *State) SaveEncrypted(w io.Writer, kek []byte) error {
+	return axolotlSaveEncrypted(s, w, kek, s.randomSource())
+}
+
+//LoadEncrypted reads a state written by SaveEncrypted, rd is read until EOF
+//It returns ErrInvalidState if the key is wrong or the data has been tampered with
+func LoadEncrypted(rd io.Reader, kek []byte) (*State, error) {
+	return axolotlLoadEncrypted(rd, kek)
+}
+
+//SaveEncryptedPassphrase writes the state to w encrypted under a key derived from passphrase by Argon2id
+func (s *State) SaveEncryptedPassphrase(w io.Writer, passphrase []byte) error {
+	return axolotlSaveEncryptedPassphrase(s, w, passphrase, s.randomSource())
+}
+
+//LoadEncryptedPassphrase reads a state written by SaveEncryptedPassphrase, rd is read until EOF
+//It returns ErrInvalidState if the passphrase is wrong or the data has been tampered with
+func LoadEncryptedPassphrase(rd io.Reader, passphrase []byte) (*State, error) {
+	return axolotlLoadEncryptedPassphrase(rd, passphrase)
+}
+
 //DecryptMessage decrypts the message
+//Failures caused by the message are returned as *DecryptError, see there. If rd
+//ends within the message io.ErrUnexpectedEOF is returned and the state is unchanged.
 func (s *State) DecryptMessage(rd io.Reader) ([]byte, error) {
-	return axolotlDecryptMessage(s, rd)
+	return axolotlDecryptMessage(s, rd, nil)
 }
 
 //DecryptMessageBuffer decrypts the message
 func (s *State) DecryptMessageBuffer(b []byte) ([]byte, error) {
-	return axolotlDecryptMessageBuffer(s, b)
+	return axolotlDecryptMessageBuffer(s, b, nil)
+}
+
+//DecryptMessageAD decrypts the message and verifies the associated data ad
+//The associated data has to match the data passed to EncryptMessageAD
+func (s *State) DecryptMessageAD(b, ad []byte) ([]byte, error) {
+	return axolotlDecryptMessageBuffer(s, b, ad)
+}
+
+//DecryptMessageReaderAD decrypts the message read from rd and verifies the associated data ad
+func (s *State) DecryptMessageReaderAD(rd io.Reader, ad []byte) ([]byte, error) {
+	return axolotlDecryptMessage(s, rd, ad)
 }
 
 //EncryptMessage encrypts the message
 func (s *State) EncryptMessage(message []byte) ([]byte, error) {
-	return axolotlEncryptMessage(s, message, rand.Reader)
+	return axolotlEncryptMessage(s, message, nil, s.randomSource())
+}
+
+//EncryptMessageAD encrypts the message and authenticates the associated data ad
+//The associated data is not part of the ciphertext, the receiver has to supply the same data to DecryptMessageAD
+func (s *State) EncryptMessageAD(message, ad []byte) ([]byte, error) {
+	return axolotlEncryptMessage(s, message, ad, s.randomSource())
+}
+
+//EncryptStream encrypts everything read from r until EOF and writes the ciphertext to w
+//The stream takes one message of the sending chain and is split into chunks, so
+//memory use does not depend on its length. Chunks cannot be reordered, dropped or
+//truncated without DecryptStream noticing.
+func (s *State) EncryptStream(w io.Writer, r io.Reader) error {
+	return axolotlEncryptStream(s, w, r, s.randomSource(), noLock{})
+}
+
+//DecryptStream decrypts a stream written by EncryptStream from r and writes the plaintext to w
+//Chunks are written to w as soon as they are authenticated, the plaintext is only
+//complete if DecryptStream returns nil. A stream cut short returns ErrTruncatedStream.
+func (s *State) DecryptStream(w io.Writer, r io.Reader) error {
+	return axolotlDecryptStream(s, w, r, noLock{})
+}
+
+//SetRandom sets the source of all randomness the state uses, nil restores crypto/rand
+//With a deterministic source the same inputs yield the same ciphertexts, which
+//allows known-answer tests and replaying sessions bit for bit, including the
+//ML-KEM encapsulation of the post-quantum ratchet. Never use a predictable source outside of tests. The source is not saved with the state.
+func (s *State) SetRandom(random io.Reader) {
+	s.random = random
+}
+
+//SetClock sets the clock the state uses to age skipped message keys, nil restores time.Now
+//The clock is not saved with the state.
+func (s *State) SetClock(clock func() time.Time) {
+	s.clock = clock
+}
+
+//EnablePQRatchet mixes ML-KEM shared secrets into the root key alongside the DH ratchet
+//Every interval sending DH ratchet steps a new encapsulation key is offered in the header,
+//the peer answers with a ciphertext in the header of its next chain.
+//Both parties have to enable it with the same KEM before the first message is exchanged.
+func (s *State) EnablePQRatchet(KEM uint8, interval uint32) error {
+	return axolotlEnablePQRatchet(s, KEM, interval)
+}
+
+//SetSkippedKeyStore replaces the store of the keys of skipped messages
+//The keys held by the in-memory store are moved to the new store. Other stores cannot enumerate
+//their keys, replacing one which still holds keys fails with ErrSkippedKeysNotMoved. Only keys of
+//the in-memory store are saved with the state, after loading a state the store has to be set again.
+func (s *State) SetSkippedKeyStore(store SkippedKeyStore) error {
+	return axolotlSetSkippedKeyStore(s, store)
+}
+
+//RegisterCipher registers an AEAD under a new id and name so it can be used as StreamCipher
+//newAEAD gets passed a key of 32 bytes
+func RegisterCipher(id uint8, name string, newAEAD func(key []byte) (cipher.AEAD, error)) error {
+	return registerCipher(id, name, newAEAD)
+}
+
+//RegisterCurve registers a DH function under a new id and name so it can be used as CurveParam
+//generate returns a new key pair, sharedSecret computes the agreement of a key pair with a peer's public key
+func RegisterCurve(id uint8, name string, generate func(randomData io.Reader) (*ecdh.ECDH, error), sharedSecret func(params *ecdh.ECDH, publicKey []byte) ([]byte, error)) error {
+	return registerCurve(id, name, generate, sharedSecret)
+}
+
+//RegisterKDF registers a key derivation function under a new id and name so it can be used as HKDF
+func RegisterKDF(id uint8, name string, kdf func(secret, salt, info []byte) io.Reader) error {
+	return registerKDF(id, name, kdf)
+}
+
+//RegisterMAC registers a keyed hash under a new id and name so it can be used as HMAC
+func RegisterMAC(id uint8, name string, mac func(key []byte) hash.Hash) error {
+	return registerMAC(id, name, mac)
+}
+
+//CipherName returns the registered name of the stream cipher id or an empty string
+func CipherName(id uint8) string {
+	return algorithmName(cipherNames, id)
+}
+
+//CurveName returns the registered name of the curve id or an empty string
+func CurveName(id uint8) string {
+	return algorithmName(curveNames, id)
+}
+
+//KDFName returns the registered name of the key derivation function id or an empty string
+func KDFName(id uint8) string {
+	return algorithmName(kdfNames, id)
+}
+
+//MACName returns the registered name of the MAC id or an empty string
+func MACName(id uint8) string {
+	return algorithmName(macNames, id)
+}
+
+//LookupCipher returns the id of the stream cipher registered under name
+func LookupCipher(name string) (uint8, error) {
+	return algorithmID(cipherNames, name)
+}
+
+//LookupCurve returns the id of the curve registered under name
+func LookupCurve(name string) (uint8, error) {
+	return algorithmID(curveNames, name)
+}
+
+//LookupKDF returns the id of the key derivation function registered under name
+func LookupKDF(name string) (uint8, error) {
+	return algorithmID(kdfNames, name)
+}
+
+//LookupMAC returns the id of the MAC registered under name
+func LookupMAC(name string) (uint8, error) {
+	return algorithmID(macNames, name)
 }
 
 //NewP521_SHA512_AESGCM256_Sender returns axolotl with max security
 func NewP521_SHA512_AESGCM256_Sender(masterKey, dhPublicKey []byte) (*State, error) {
-	return NewSender(CurveP521, AES_GCM_256, HKDF_SHA_512, HMAC_SHA_512, masterKey, dhPublicKey)
+	return NewSenderWithSuite(SuiteP521_SHA512_AESGCM256, masterKey, dhPublicKey)
 }
 
 //NewP521_SHA512_AESGCM256_Receiver returns axolotl with max security
 func NewP521_SHA512_AESGCM256_Receiver(masterKey []byte, dhParams *ecdh.ECDH) (*State, error) {
-	return NewReceiver(CurveP521, AES_GCM_256, HKDF_SHA_512, HMAC_SHA_512, masterKey, dhParams)
+	return NewReceiverWithSuite(SuiteP521_SHA512_AESGCM256, masterKey, dhParams)
+}
+
+//NewIdentityKey generates a new long term identity key for the X3DH key agreement
+func NewIdentityKey(curveParam uint8, randomData io.Reader) (*IdentityKey, error) {
+	return x3dhNewIdentityKey(curveParam, randomData)
+}
+
+//NewSignedPreKey generates a new signed prekey with the given id signed by the identity key ik
+func NewSignedPreKey(ik *IdentityKey, id uint32, randomData io.Reader) (*SignedPreKey, error) {
+	return x3dhNewSignedPreKey(ik, id, randomData)
+}
+
+//NewPreKeys generates n one-time prekeys with consecutive ids starting at firstID
+func NewPreKeys(curveParam uint8, firstID uint32, n int, randomData io.Reader) ([]*PreKey, error) {
+	return x3dhNewPreKeys(curveParam, firstID, n, randomData)
+}
+
+//NewPQPreKey generates a new post-quantum prekey for the KEM with the given id signed by the identity key ik
+func NewPQPreKey(ik *IdentityKey, id uint32, KEM uint8, randomData io.Reader) (*PQPreKey, error) {
+	return x3dhNewPQPreKey(ik, id, KEM, randomData)
+}
+
+//NewPreKeyBundle returns the bundle to publish for the given keys, opk may be nil
+func NewPreKeyBundle(ik *IdentityKey, spk *SignedPreKey, opk *PreKey) *PreKeyBundle {
+	return x3dhNewPreKeyBundle(ik, spk, nil, opk)
+}
+
+//NewPQPreKeyBundle returns the bundle to publish for the given keys including the post-quantum prekey, opk may be nil
+func NewPQPreKeyBundle(ik *IdentityKey, spk *SignedPreKey, pqpk *PQPreKey, opk *PreKey) *PreKeyBundle {
+	return x3dhNewPreKeyBundle(ik, spk, pqpk, opk)
+}
+
+//X3DHInitiate runs the initiator side of the X3DH key agreement against the responder's bundle
+//It returns the sending state and the message the responder needs to pass to X3DHRespond.
+//randomData is used for the ephemeral key and becomes the random source of the state.
+func X3DHInitiate(ik *IdentityKey, bundle *PreKeyBundle, streamCipher, HKDF, HMAC uint8, randomData io.Reader) (*State, *X3DHMessage, error) {
+	return x3dhInitiate(ik, bundle, streamCipher, HKDF, HMAC, randomData)
+}
+
+//X3DHRespond runs the responder side of the X3DH key agreement and returns the receiving state
+//opk has to be the one-time prekey referenced by msg or nil if none was used, afterwards it must be deleted.
+//randomData becomes the random source of the state.
+func X3DHRespond(ik *IdentityKey, spk *SignedPreKey, opk *PreKey, msg *X3DHMessage, streamCipher, HKDF, HMAC uint8, randomData io.Reader) (*State, error) {
+	return x3dhRespond(ik, spk, opk, msg, streamCipher, HKDF, HMAC, randomData)
+}
+
+//PQXDHInitiate runs the initiator side of the hybrid PQXDH key agreement
+//The master key is derived from the X3DH agreement and an encapsulation to the bundle's post-quantum prekey,
+//the KEM ciphertext is carried in the returned message. randomData is used for the ephemeral key and the
+//encapsulation and becomes the random source of the state.
+func PQXDHInitiate(ik *IdentityKey, bundle *PreKeyBundle, streamCipher, HKDF, HMAC uint8, randomData io.Reader) (*State, *X3DHMessage, error) {
+	return pqxdhInitiate(ik, bundle, streamCipher, HKDF, HMAC, randomData)
+}
+
+//PQXDHRespond runs the responder side of the hybrid PQXDH key agreement and returns the receiving state
+//randomData becomes the random source of the state.
+func PQXDHRespond(ik *IdentityKey, spk *SignedPreKey, pqpk *PQPreKey, opk *PreKey, msg *X3DHMessage, streamCipher, HKDF, HMAC uint8, randomData io.Reader) (*State, error) {
+	return pqxdhRespond(ik, spk, pqpk, opk, msg, streamCipher, HKDF, HMAC, randomData)
+}
+
+//X3DHAssociatedData returns the associated data both parties should pass to EncryptMessageAD and DecryptMessageAD
+func X3DHAssociatedData(initiatorIdentityKey, responderIdentityKey []byte) []byte {
+	return x3dhAssociatedData(initiatorIdentityKey, responderIdentityKey)
+}
+
+//Serialize returns the wire encoding of the bundle
+func (b *PreKeyBundle) Serialize() []byte {
+	return serializePreKeyBundle(b)
+}
+
+//DeserializePreKeyBundle parses a bundle produced by PreKeyBundle.Serialize
+func DeserializePreKeyBundle(b []byte) (*PreKeyBundle, error) {
+	return deserializePreKeyBundle(b)
+}
+
+//Serialize returns the wire encoding of the handshake message
+func (m *X3DHMessage) Serialize() []byte {
+	return serializeX3DHMessage(m)
+}
+
+//DeserializeX3DHMessage parses a handshake message produced by X3DHMessage.Serialize
+func DeserializeX3DHMessage(b []byte) (*X3DHMessage, error) {
+	return deserializeX3DHMessage(b)
 }
@@ -5,8 +5,16 @@ import (
 	"crypto/cipher"
 	"crypto/elliptic"
 	"crypto/hmac"
+	"crypto/mlkem"
+	"crypto/mlkem/mlkemtest"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
+	"github.com/arcpop/ecdh"
+	"github.com/cloudflare/circl/dh/x448"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/sha3"
 	"hash"
@@ -15,7 +23,6 @@ import (
 
 type key []byte
 type dhkey []byte
-type storedkey [2]key
 
 var streamCiphers = map[uint8]func([]byte) (cipher.AEAD, error){
 	AES_GCM_128: func(key []byte) (cipher.AEAD, error) {
@@ -48,29 +55,262 @@ var streamCiphers = map[uint8]func([]byte) (cipher.AEAD, error){
 		}
 		return cipher.NewGCM(c)
 	},
+	CHACHA20_POLY1305: func(key []byte) (cipher.AEAD, error) {
+		if len(key) < chacha20poly1305.KeySize {
+			return nil, ErrInvalidKeyLength
+		}
+		return chacha20poly1305.New(key[0:chacha20poly1305.KeySize])
+	},
+	XCHACHA20_POLY1305: func(key []byte) (cipher.AEAD, error) {
+		if len(key) < chacha20poly1305.KeySize {
+			return nil, ErrInvalidKeyLength
+		}
+		return chacha20poly1305.NewX(key[0:chacha20poly1305.KeySize])
+	},
+}
+
+//dhCurve bundles the operations needed to run the DH ratchet on a curve.
+//The montgomery curves have no elliptic.Curve, for them curve is nil and the
+//key pairs are stored as raw scalars and u-coordinates in an ecdh.ECDH.
+type dhCurve struct {
+	curve        elliptic.Curve
+	generate     func(randomData io.Reader) (*ecdh.ECDH, error)
+	sharedSecret func(params *ecdh.ECDH, publicKey []byte) ([]byte, error)
+	//publicKey derives the public key of a private key, it is nil for registered curves
+	publicKey func(privateKey []byte) ([]byte, error)
+}
+
+var dhCurves = map[uint8]dhCurve{
+	CurveP224:   nistCurve(elliptic.P224()),
+	CurveP256:   nistCurve(elliptic.P256()),
+	CurveP384:   nistCurve(elliptic.P384()),
+	CurveP521:   nistCurve(elliptic.P521()),
+	CurveX25519: {generate: generateX25519, sharedSecret: sharedSecretX25519, publicKey: publicKeyX25519},
+	CurveX448:   {generate: generateX448, sharedSecret: sharedSecretX448, publicKey: publicKeyX448},
+}
+
+//checkKeyPair returns ErrInvalidKeyPair unless the public key of kp belongs to its private key
+//Registered curves cannot derive public keys, for them the shared secrets of kp
+//and a fixed key pair have to agree when computed from either side.
+func (c dhCurve) checkKeyPair(kp *ecdh.ECDH) error {
+	if c.publicKey != nil {
+		pub, err := c.publicKey(kp.PrivateKey)
+		if err != nil || subtle.ConstantTimeCompare(pub, kp.PublicKey) != 1 {
+			return ErrInvalidKeyPair
+		}
+		return nil
+	}
+	probe, err := c.generate(hkdf.New(sha256.New, []byte("axolotl key pair check"), nil, nil))
+	if err != nil {
+		return err
+	}
+	defer zeroKey(probe.PrivateKey)
+	ours, err := c.sharedSecret(kp, probe.PublicKey)
+	if err != nil {
+		return ErrInvalidKeyPair
+	}
+	defer zeroKey(ours)
+	theirs, err := c.sharedSecret(probe, kp.PublicKey)
+	if err != nil {
+		return ErrInvalidKeyPair
+	}
+	defer zeroKey(theirs)
+	if subtle.ConstantTimeCompare(ours, theirs) != 1 {
+		return ErrInvalidKeyPair
+	}
+	return nil
+}
+
+func nistCurve(c elliptic.Curve) dhCurve {
+	return dhCurve{
+		curve: c,
+		generate: func(randomData io.Reader) (*ecdh.ECDH, error) {
+			return ecdh.GenerateNew(c, randomData)
+		},
+		sharedSecret: func(params *ecdh.ECDH, publicKey []byte) ([]byte, error) {
+			return params.GetSharedSecret(publicKey)
+		},
+		publicKey: func(privateKey []byte) ([]byte, error) {
+			if len(privateKey) != (c.Params().BitSize+7)/8 {
+				return nil, ErrInvalidKeyLength
+			}
+			x, y := c.ScalarBaseMult(privateKey)
+			return elliptic.Marshal(c, x, y), nil
+		},
+	}
+}
+
+func generateX25519(randomData io.Reader) (*ecdh.ECDH, error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	_, err := io.ReadFull(randomData, priv)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return &ecdh.ECDH{PrivateKey: priv, PublicKey: pub}, nil
 }
 
-var dhCurves = map[uint8]func() elliptic.Curve{
-	CurveP224: elliptic.P224,
-	CurveP256: elliptic.P256,
-	CurveP384: elliptic.P384,
-	CurveP521: elliptic.P521,
+func publicKeyX25519(privateKey []byte) ([]byte, error) {
+	if len(privateKey) != curve25519.ScalarSize {
+		return nil, ErrInvalidKeyLength
+	}
+	return curve25519.X25519(privateKey, curve25519.Basepoint)
+}
+
+func sharedSecretX25519(params *ecdh.ECDH, publicKey []byte) ([]byte, error) {
+	if len(params.PrivateKey) != curve25519.ScalarSize || len(publicKey) != curve25519.PointSize {
+		return nil, ErrInvalidKeyLength
+	}
+	return curve25519.X25519(params.PrivateKey, publicKey)
+}
+
+func generateX448(randomData io.Reader) (*ecdh.ECDH, error) {
+	var priv, pub x448.Key
+	_, err := io.ReadFull(randomData, priv[:])
+	if err != nil {
+		return nil, err
+	}
+	x448.KeyGen(&pub, &priv)
+	return &ecdh.ECDH{PrivateKey: priv[:], PublicKey: pub[:]}, nil
+}
+
+func publicKeyX448(privateKey []byte) ([]byte, error) {
+	var priv, pub x448.Key
+	if len(privateKey) != x448.Size {
+		return nil, ErrInvalidKeyLength
+	}
+	copy(priv[:], privateKey)
+	x448.KeyGen(&pub, &priv)
+	return pub[:], nil
+}
+
+func sharedSecretX448(params *ecdh.ECDH, publicKey []byte) ([]byte, error) {
+	var priv, pub, shared x448.Key
+	if len(params.PrivateKey) != x448.Size || len(publicKey) != x448.Size {
+		return nil, ErrInvalidKeyLength
+	}
+	copy(priv[:], params.PrivateKey)
+	copy(pub[:], publicKey)
+	if !x448.Shared(&shared, &priv, &pub) {
+		return nil, ErrInvalidPublicKey
+	}
+	return shared[:], nil
 }
 
 var hmacs = map[uint8]func([]byte) hash.Hash{
 	HMAC_SHA_256:  func(key []byte) hash.Hash { return hmac.New(sha256.New, key) },
 	HMAC_SHA_384:  func(key []byte) hash.Hash { return hmac.New(sha512.New384, key) },
-	HMAC_SHA_512:  func(key []byte) hash.Hash { return hmac.New(sha256.New, key) },
+	HMAC_SHA_512:  func(key []byte) hash.Hash { return hmac.New(sha512.New, key) },
 	HMAC_SHA3_256: func(key []byte) hash.Hash { return hmac.New(sha3.New256, key) },
 	HMAC_SHA3_384: func(key []byte) hash.Hash { return hmac.New(sha3.New384, key) },
 	HMAC_SHA3_512: func(key []byte) hash.Hash { return hmac.New(sha3.New512, key) },
+
+	HMAC_SHA_512_COMPAT: func(key []byte) hash.Hash { return hmac.New(sha256.New, key) },
 }
 
 var hkdfs = map[uint8]func([]byte, []byte, []byte) io.Reader{
 	HKDF_SHA_256:  func(secret, salt, info []byte) io.Reader { return hkdf.New(sha256.New, secret, salt, info) },
 	HKDF_SHA_384:  func(secret, salt, info []byte) io.Reader { return hkdf.New(sha512.New384, secret, salt, info) },
-	HKDF_SHA_512:  func(secret, salt, info []byte) io.Reader { return hkdf.New(sha256.New, secret, salt, info) },
+	HKDF_SHA_512:  func(secret, salt, info []byte) io.Reader { return hkdf.New(sha512.New, secret, salt, info) },
 	HKDF_SHA3_256: func(secret, salt, info []byte) io.Reader { return hkdf.New(sha3.New256, secret, salt, info) },
 	HKDF_SHA3_384: func(secret, salt, info []byte) io.Reader { return hkdf.New(sha3.New384, secret, salt, info) },
 	HKDF_SHA3_512: func(secret, salt, info []byte) io.Reader { return hkdf.New(sha3.New512, secret, salt, info) },
+
+	HKDF_SHA_512_COMPAT: func(secret, salt, info []byte) io.Reader { return hkdf.New(sha256.New, secret, salt, info) },
+}
+
+//kemScheme bundles the operations of a key encapsulation mechanism.
+//Decapsulation keys are kept in their seed form. Encapsulation uses the
+//system's randomness unless a different source is passed, which then supplies
+//the 32 bytes the ciphertext is derived from.
+type kemScheme struct {
+	encapsulationKeySize int
+	ciphertextSize       int
+	generate             func(randomData io.Reader) (dk, ek []byte, err error)
+	encapsulate          func(ek []byte, randomData io.Reader) (sharedKey, ciphertext []byte, err error)
+	decapsulate          func(dk, ciphertext []byte) ([]byte, error)
+}
+
+var kems = map[uint8]kemScheme{
+	ML_KEM_768: {
+		encapsulationKeySize: mlkem.EncapsulationKeySize768,
+		ciphertextSize:       mlkem.CiphertextSize768,
+		generate: func(randomData io.Reader) ([]byte, []byte, error) {
+			seed := make([]byte, mlkem.SeedSize)
+			_, err := io.ReadFull(randomData, seed)
+			if err != nil {
+				return nil, nil, err
+			}
+			dk, err := mlkem.NewDecapsulationKey768(seed)
+			if err != nil {
+				return nil, nil, err
+			}
+			return seed, dk.EncapsulationKey().Bytes(), nil
+		},
+		encapsulate: func(ek []byte, randomData io.Reader) ([]byte, []byte, error) {
+			k, err := mlkem.NewEncapsulationKey768(ek)
+			if err != nil {
+				return nil, nil, err
+			}
+			if randomData == rand.Reader {
+				sharedKey, ciphertext := k.Encapsulate()
+				return sharedKey, ciphertext, nil
+			}
+			m := make([]byte, 32)
+			_, err = io.ReadFull(randomData, m)
+			if err != nil {
+				return nil, nil, err
+			}
+			return mlkemtest.Encapsulate768(k, m)
+		},
+		decapsulate: func(seed, ciphertext []byte) ([]byte, error) {
+			dk, err := mlkem.NewDecapsulationKey768(seed)
+			if err != nil {
+				return nil, err
+			}
+			return dk.Decapsulate(ciphertext)
+		},
+	},
+	ML_KEM_1024: {
+		encapsulationKeySize: mlkem.EncapsulationKeySize1024,
+		ciphertextSize:       mlkem.CiphertextSize1024,
+		generate: func(randomData io.Reader) ([]byte, []byte, error) {
+			seed := make([]byte, mlkem.SeedSize)
+			_, err := io.ReadFull(randomData, seed)
+			if err != nil {
+				return nil, nil, err
+			}
+			dk, err := mlkem.NewDecapsulationKey1024(seed)
+			if err != nil {
+				return nil, nil, err
+			}
+			return seed, dk.EncapsulationKey().Bytes(), nil
+		},
+		encapsulate: func(ek []byte, randomData io.Reader) ([]byte, []byte, error) {
+			k, err := mlkem.NewEncapsulationKey1024(ek)
+			if err != nil {
+				return nil, nil, err
+			}
+			if randomData == rand.Reader {
+				sharedKey, ciphertext := k.Encapsulate()
+				return sharedKey, ciphertext, nil
+			}
+			m := make([]byte, 32)
+			_, err = io.ReadFull(randomData, m)
+			if err != nil {
+				return nil, nil, err
+			}
+			return mlkemtest.Encapsulate1024(k, m)
+		},
+		decapsulate: func(seed, ciphertext []byte) ([]byte, error) {
+			dk, err := mlkem.NewDecapsulationKey1024(seed)
+			if err != nil {
+				return nil, err
+			}
+			return dk.Decapsulate(ciphertext)
+		},
+	},
 }
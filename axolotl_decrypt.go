@@ -1,50 +1,69 @@
 package axolotl
 
 import (
-	"container/list"
-	"encoding/binary"
+	"crypto/subtle"
+	"errors"
 	"io"
-	"log"
 )
 
-func tryDecrypt(s *State, msg *message, hk, mk key) ([]byte, bool) {
-	_, err := tryDecryptHeader(s, hk, msg)
-	if err != nil {
-		return nil, false
-	}
+//decryptFailure returns err as a *DecryptError for the message n of the chain of
+//the sender's ratchet key rk, both are unknown until the header is decrypted
+func decryptFailure(err error, n uint32, rk []byte) error {
+	return &DecryptError{Err: err, MessageNumber: n, RatchetKey: rk}
+}
 
-	content, err := tryDecryptMessage(s, mk, msg)
-	if err != nil {
-		return nil, false
-	}
-	return content, true
+//isMessageError tells errors caused by the message itself from errors of the
+//reader or the SkippedKeyStore, which are returned as they are
+func isMessageError(err error) bool {
+	return errors.Is(err, ErrMalformedMessage) || errors.Is(err, ErrUnsupportedVersion) || errors.Is(err, ErrMessageTooLarge)
 }
 
-func tryDecryptWithSkippedKeys(s *State, m *message) ([]byte, bool) {
-	var el *list.Element
-	var buf []byte
-	var ok = false
-	if s.skippedKeys.Len() < 1 {
-		return nil, false
-	}
-	for e := s.skippedKeys.Front(); e != nil; e = e.Next() {
-		k := e.Value.(storedkey)
-		hk := k[0]
-		mk := k[1]
-		buf, ok = tryDecrypt(s, m, hk, mk)
-		if ok {
-			el = e
-			break
-		}
+//tryDecryptWithSkippedKeys tries the header keys of all stored skipped keys and
+//decrypts the message if the store holds the key for its message number
+//A header of an older chain without a stored key for the message means the key
+//has been evicted, duplicates are caught by checkReplay before.
+func tryDecryptWithSkippedKeys(s *State, m *message, ad []byte, seen seenMessage) ([]byte, key, bool, error) {
+	hks, err := s.skippedKeys.HeaderKeys()
+	if err != nil {
+		return nil, nil, false, err
 	}
-	if ok {
-		s.skippedKeys.Remove(el)
-		return buf, ok
+	for _, hk := range hks {
+		hdr, err := tryDecryptHeader(s, hk, m, ad)
+		if err != nil {
+			continue
+		}
+		n, _, dhrp, _, err := decodeHeader(s, hdr)
+		if err != nil {
+			return nil, nil, false, decryptFailure(err, 0, nil)
+		}
+		mk, ok, err := s.skippedKeys.Lookup(hk, n)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if !ok {
+			//Messages of the current chain are handled by decryptInner
+			if subtle.ConstantTimeCompare(hk, s.hdrKeyR) == 1 {
+				continue
+			}
+			return nil, nil, false, decryptFailure(ErrExpiredMessage, n, dhrp)
+		}
+		msg, err := tryDecryptMessage(s, mk, m, ad)
+		if err != nil {
+			return nil, nil, false, decryptFailure(err, n, dhrp)
+		}
+		err = s.skippedKeys.Delete(hk, n)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		recordSeen(s, dhrp, n, seen)
+		//A failed eviction is retried by the next decryption
+		evictSkippedKeys(s)
+		return msg, mk, true, nil
 	}
-	return nil, false
+	return nil, nil, false, nil
 }
 
-func tryDecryptHeader(s *State, hk key, msg *message) ([]byte, error) {
+func tryDecryptHeader(s *State, hk key, msg *message, ad []byte) ([]byte, error) {
 	if len(hk) == 0 {
 		return nil, ErrInvalidKeyLength
 	}
@@ -52,11 +71,15 @@ func tryDecryptHeader(s *State, hk key, msg *message) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(msg.headerNonce) != headerCipher.NonceSize() {
+		return nil, ErrMalformedMessage
+	}
 
-	return headerCipher.Open(nil, msg.headerNonce, msg.headerData, nil)
+	return headerCipher.Open(nil, msg.headerNonce, msg.headerData, headerAD(ad, msg))
 }
 
-func tryDecryptMessage(s *State, mk key, msg *message) ([]byte, error) {
+//tryDecryptMessage returns ErrBodyAuthentication if the body is not authentic
+func tryDecryptMessage(s *State, mk key, msg *message, ad []byte) ([]byte, error) {
 	if len(mk) == 0 {
 		return nil, ErrInvalidKeyLength
 	}
@@ -64,90 +87,168 @@ func tryDecryptMessage(s *State, mk key, msg *message) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return msgCipher.Open(nil, msg.messageNonce, msg.messageData, nil)
+	if len(msg.messageNonce) != msgCipher.NonceSize() {
+		return nil, ErrMalformedMessage
+	}
+	pt, err := msgCipher.Open(nil, msg.messageNonce, msg.messageData, messageAD(ad, msg))
+	if err != nil {
+		return nil, ErrBodyAuthentication
+	}
+	if msg.flags&wireFlagPadded == 0 {
+		return pt, nil
+	}
+	return unpad(pt)
 }
-func axolotlDecryptMessageBuffer(s *State, b []byte) ([]byte, error) {
-	m, err := deserialize(b)
+func axolotlDecryptMessageBuffer(s *State, b, ad []byte) ([]byte, error) {
+	m, err := deserialize(b, s.Limits)
 
 	if err != nil {
-		return nil, err
+		return nil, decryptFailure(err, 0, nil)
 	}
-	return decryptInner(s, m)
+	return decryptInner(s, m, ad)
 }
 
-func axolotlDecryptMessage(s *State, rd io.Reader) ([]byte, error) {
-	m, err := deserializeFromReader(rd)
+func axolotlDecryptMessage(s *State, rd io.Reader, ad []byte) ([]byte, error) {
+	m, err := deserializeFromReader(rd, s.Limits)
 
 	if err != nil {
+		if isMessageError(err) {
+			return nil, decryptFailure(err, 0, nil)
+		}
 		return nil, err
 	}
-	return decryptInner(s, m)
+	return decryptInner(s, m, ad)
+}
+
+//decryptInner decrypts the message and advances the state if it is authentic
+//Failures caused by the message are returned as *DecryptError.
+func decryptInner(s *State, m *message, ad []byte) ([]byte, error) {
+	msg, mk, err := decryptMessage(s, m, ad)
+	zeroKey(mk)
+	return msg, err
 }
-func decryptInner(s *State, m *message) ([]byte, error) {
+
+//decryptMessage is decryptInner returning the message key as well
+func decryptMessage(s *State, m *message, ad []byte) ([]byte, key, error) {
 	var err error
-	msg, ok := tryDecryptWithSkippedKeys(s, m)
+	if m.suiteID != 0 && s.suiteID != 0 && m.suiteID != s.suiteID {
+		return nil, nil, decryptFailure(ErrUnknownSuite, 0, nil)
+	}
+	//Releases without the envelope ran SHA-256 for the SHA-512 ids, so a
+	//legacy message cannot belong to a state really using SHA-512
+	if m.version == wireVersionLegacy && (s.HKDF == HKDF_SHA_512 || s.HMAC == HMAC_SHA_512) {
+		return nil, nil, decryptFailure(ErrUnknownSuite, 0, nil)
+	}
+	seen := digestMessage(m, ad)
+	err = checkReplay(s, seen)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, mk, ok, err := tryDecryptWithSkippedKeys(s, m, ad, seen)
+	if err != nil {
+		return nil, nil, err
+	}
 	if ok {
-		return msg, nil
+		return msg, mk, nil
 	}
 
 	var hdr []byte
 
-	if hdr, err = tryDecryptHeader(s, s.hdrKeyR, m); err == nil {
-		np := binary.BigEndian.Uint32(hdr[0:4])
-		ckp, mk := stageSkippedHeaderAndMessageKeys(s, s.hdrKeyR, s.msgNumR, np, s.chainKeyR)
-		if ckp != nil && mk != nil {
-			msg, err = tryDecryptMessage(s, mk, m)
-			if err != nil {
-				return nil, err
-			}
-			commitStagedSkippedKeys(s)
-			s.msgNumR = np + 1
-			s.chainKeyR = ckp
-			return msg, nil
+	if hdr, err = tryDecryptHeader(s, s.hdrKeyR, m, ad); err == nil {
+		np, _, dhrp, _, err := decodeHeader(s, hdr)
+		if err != nil {
+			return nil, nil, decryptFailure(err, 0, nil)
+		}
+		if np < s.msgNumR {
+			//The key is not stored anymore, see tryDecryptWithSkippedKeys
+			return nil, nil, decryptFailure(ErrExpiredMessage, np, dhrp)
+		}
+		ckp, mk, staged, err := stageSkippedHeaderAndMessageKeys(s, nil, s.hdrKeyR, s.msgNumR, np, s.chainKeyR, s.ratchetSteps)
+		if err != nil {
+			return nil, nil, decryptFailure(err, np, dhrp)
+		}
+		msg, err = tryDecryptMessage(s, mk, m, ad)
+		if err != nil {
+			return nil, nil, decryptFailure(err, np, dhrp)
+		}
+		err = commitSkippedKeys(s, staged)
+		if err != nil {
+			return nil, nil, err
 		}
-		return nil, ErrUndecryptable
+		recordSeen(s, dhrp, np, seen)
+		s.msgNumR = np + 1
+		s.chainKeyR = ckp
+		//A failed eviction is retried by the next decryption
+		evictSkippedKeys(s)
+		return msg, mk, nil
 	}
 	//else
-	if hdr, err = tryDecryptHeader(s, s.nextHdrKeyR, m); err != nil || s.ratchetFlag {
-		return nil, ErrUndecryptable
+	lockRoot(s)
+	defer unlockRoot(s)
+	if hdr, err = tryDecryptHeader(s, s.nextHdrKeyR, m, ad); err != nil {
+		if errors.Is(err, ErrMalformedMessage) {
+			return nil, nil, decryptFailure(err, 0, nil)
+		}
+		return nil, nil, decryptFailure(ErrHeaderAuthentication, 0, nil)
 	}
 
-	np := binary.BigEndian.Uint32(hdr[0:4])
-	pnp := binary.BigEndian.Uint32(hdr[4:8])
-	dhrp := hdr[8:]
+	np, pnp, dhrp, pqExt, err := decodeHeader(s, hdr)
+	if err != nil {
+		return nil, nil, decryptFailure(err, 0, nil)
+	}
+	//The peer started a new chain although it has not seen our last one, the
+	//states have diverged
+	if s.ratchetFlag {
+		return nil, nil, decryptFailure(ErrStaleSession, np, dhrp)
+	}
 
-	stageSkippedHeaderAndMessageKeys(s, s.hdrKeyR, s.msgNumR, pnp, s.chainKeyR)
+	if s.Limits.MaxSkip > 0 && np > s.Limits.MaxSkip {
+		return nil, nil, decryptFailure(ErrTooManySkipped, np, dhrp)
+	}
+	_, staged, err := stageSkippedKeys(s, nil, s.hdrKeyR, s.msgNumR, pnp, s.chainKeyR, s.ratchetSteps)
+	if err != nil {
+		return nil, nil, decryptFailure(err, np, dhrp)
+	}
 	hkp := s.nextHdrKeyR
 
-	dhSecret, err := s.dhParams.GetSharedSecret(dhrp)
+	dhSecret, err := s.dh.sharedSecret(s.dhParams, dhrp)
 	if err != nil {
-		return nil, ErrMalformedMessage
+		return nil, nil, decryptFailure(ErrMalformedMessage, np, dhrp)
 	}
 
-	hm := s.hmac(s.rootKey).Sum(dhSecret)
+	var kemSecret, pqPeerEncapKey []byte
+	if s.pqRatchet {
+		kemSecret, pqPeerEncapKey, err = pqRatchetReceive(s, pqExt)
+		if err != nil {
+			return nil, nil, decryptFailure(ErrMalformedMessage, np, dhrp)
+		}
+	}
+
+	hm := s.hmac(s.rootKey).Sum(append(dhSecret, kemSecret...))
 	kdf := s.hkdf(hm, nil, nil)
 
 	rkp := make([]byte, 32)
 	nhkp := make([]byte, 32)
 	ckp := make([]byte, 32)
 
-	_, err = io.ReadFull(kdf, rkp)
-	if err != nil { //This will never happen, we only pull 3 * 32 bytes from the kdf
-		log.Fatal(err)
+	for _, k := range [][]byte{rkp, nhkp, ckp} {
+		_, err = io.ReadFull(kdf, k)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
-	_, err = io.ReadFull(kdf, nhkp)
-	if err != nil { //This will never happen, we only pull 3 * 32 bytes from the kdf
-		log.Fatal(err)
+	ckp, mk, staged, err = stageSkippedHeaderAndMessageKeys(s, staged, hkp, 0, np, ckp, s.ratchetSteps+1)
+	if err != nil {
+		return nil, nil, decryptFailure(err, np, dhrp)
 	}
-	_, err = io.ReadFull(kdf, ckp)
-	if err != nil { //This will never happen, we only pull 3 * 32 bytes from the kdf
-		log.Fatal(err)
+	if msg, err = tryDecryptMessage(s, mk, m, ad); err != nil {
+		return nil, nil, decryptFailure(err, np, dhrp)
 	}
-	var mk key
-	ckp, mk = stageSkippedHeaderAndMessageKeys(s, hkp, 0, np, ckp)
-	if msg, err = tryDecryptMessage(s, mk, m); err != nil {
-		//Should we rather pass ErrUndecryptable here?
-		return nil, err
+
+	//Both header and body are authentic, commit the candidate state
+	err = commitSkippedKeys(s, staged)
+	if err != nil {
+		return nil, nil, err
 	}
 	s.rootKey = rkp
 	s.hdrKeyR = hkp
@@ -155,31 +256,77 @@ func decryptInner(s *State, m *message) ([]byte, error) {
 	s.dhPublicKey = dhrp
 	zeroKey(s.dhParams.PrivateKey)
 	s.ratchetFlag = true
-	commitStagedSkippedKeys(s)
+	s.ratchetSteps++
+	if kemSecret != nil {
+		zeroKey(s.pqDecapKey)
+		s.pqDecapKey = nil
+	}
+	if pqPeerEncapKey != nil {
+		s.pqPeerEncapKey = pqPeerEncapKey
+	}
+	recordSeen(s, dhrp, np, seen)
 	s.msgNumR = np + 1
 	s.chainKeyR = ckp
-	return msg, nil
+	//A failed eviction is retried by the next decryption
+	evictSkippedKeys(s)
+	return msg, mk, nil
 }
 
-func commitStagedSkippedKeys(s *State) {
-	for _, k := range s.stagedSkippedMKs {
-		s.skippedKeys.PushBack(k)
+//commitSkippedKeys stores the keys staged by a successful decryption, it is
+//called before any other part of the state changes
+func commitSkippedKeys(s *State, staged []SkippedKey) error {
+	now := s.now()
+	for i := range staged {
+		staged[i].Stored = now
 	}
-	s.stagedSkippedMKs = s.stagedSkippedMKs[:0]
+	return s.skippedKeys.Put(staged...)
+}
+
+//evictSkippedKeys drops stored keys which are older than the limits allow and
+//the oldest keys if more than MaxSkippedKeys are stored. It runs once after every
+//successful decryption, so keys can outlive MaxSkippedAge until the next one.
+func evictSkippedKeys(s *State) error {
+	l := s.Limits
+	now := s.now()
+	return s.skippedKeys.Evict(l.MaxSkippedKeys, func(k SkippedKey) bool {
+		return (l.MaxSkippedAge > 0 && now.Sub(k.Stored) > l.MaxSkippedAge) ||
+			(l.MaxSkippedRatchetSteps > 0 && s.ratchetSteps-k.RatchetStep > l.MaxSkippedRatchetSteps)
+	})
 }
-func stageSkippedHeaderAndMessageKeys(s *State, hkr key, nr, np uint32, ckr key) (key, key) {
-	if len(ckr) == 0 {
-		return nil, nil
-	}
 
-	if cap(s.stagedSkippedMKs) == 0 {
-		s.stagedSkippedMKs = make([]storedkey, 0, np)
+//stageSkippedKeys advances the chain key ckr from message nr to message np and
+//appends the message keys of the skipped messages nr..np-1 tagged with the
+//receiving ratchet step of the chain to staged. The state is not changed, the
+//staged keys are stored by commitSkippedKeys once the message is authentic.
+func stageSkippedKeys(s *State, staged []SkippedKey, hkr key, nr, np uint32, ckr key, step uint32) (key, []SkippedKey, error) {
+	if len(ckr) == 0 || np <= nr {
+		return ckr, staged, nil
+	}
+	if s.Limits.MaxSkip > 0 && np-nr > s.Limits.MaxSkip {
+		return nil, nil, ErrTooManySkipped
 	}
-	var mk key
-	for i := nr; i <= np; i++ {
-		mk = s.hmac(ckr).Sum([]byte{0})
+	if s.Limits.MaxSkippedKeys > 0 && len(staged)+int(np-nr) > s.Limits.MaxSkippedKeys {
+		return nil, nil, ErrTooManySkipped
+	}
+	for i := nr; i < np; i++ {
+		mk := s.hmac(ckr).Sum([]byte{0})
 		ckr = s.hmac(ckr).Sum([]byte{1})
-		s.stagedSkippedMKs = append(s.stagedSkippedMKs, [2]key{hkr, mk})
+		staged = append(staged, SkippedKey{HeaderKey: hkr, MessageKey: mk, N: i, RatchetStep: step})
+	}
+	return ckr, staged, nil
+}
+
+//stageSkippedHeaderAndMessageKeys stages the keys of the messages nr..np-1 and
+//returns the chain key following message np together with the message key of np
+func stageSkippedHeaderAndMessageKeys(s *State, staged []SkippedKey, hkr key, nr, np uint32, ckr key, step uint32) (key, key, []SkippedKey, error) {
+	if len(ckr) == 0 || np < nr {
+		return nil, nil, nil, ErrStaleSession
+	}
+	ckr, staged, err := stageSkippedKeys(s, staged, hkr, nr, np, ckr, step)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	return ckr, mk
+	mk := s.hmac(ckr).Sum([]byte{0})
+	ckr = s.hmac(ckr).Sum([]byte{1})
+	return ckr, mk, staged, nil
 }
@@ -3,7 +3,6 @@ package axolotl
 import (
 	"crypto/cipher"
 	"encoding/binary"
-	"github.com/arcpop/ecdh"
 	"io"
 )
 
@@ -17,21 +16,32 @@ func zeroKey(k []byte) {
 }
 
 func dhRatchetGenerateKeys(s *State, randomData io.Reader) error {
-	ecdhParams, err := ecdh.GenerateNew(s.dhParams.Curve, randomData)
+	ecdhParams, err := s.dh.generate(randomData)
 	if err != nil {
 		return err
 	}
 
     nonceSrc := make([]byte, 32)
     _, err = io.ReadFull(randomData, nonceSrc)
+    if err != nil {
+        return err
+    }
 
-	dhSecret, err := ecdhParams.GetSharedSecret(s.dhPublicKey)
+	dhSecret, err := s.dh.sharedSecret(ecdhParams, s.dhPublicKey)
 	if err != nil {
 		return err
 	}
 
-	//kdf := KDF( HMAC-HASH(RK, DH(DHRs, DHRr)) )
-	kdf := s.hkdf(s.hmac(s.rootKey).Sum(dhSecret), []byte{}, []byte{})
+	var kemSecret, pqHeader, pqDecapKey []byte
+	if s.pqRatchet {
+		kemSecret, pqHeader, pqDecapKey, err = pqRatchetSend(s, randomData)
+		if err != nil {
+			return err
+		}
+	}
+
+	//kdf := KDF( HMAC-HASH(RK, DH(DHRs, DHRr) || KEM secret) )
+	kdf := s.hkdf(s.hmac(s.rootKey).Sum(append(dhSecret, kemSecret...)), []byte{}, []byte{})
 
 	rk := make([]byte, 32)
 	_, err = io.ReadFull(kdf, rk)
@@ -63,33 +73,57 @@ func dhRatchetGenerateKeys(s *State, randomData io.Reader) error {
 	s.msgNumS = 0
 	s.ratchetFlag = false
 
+	if s.pqRatchet {
+		if kemSecret != nil {
+			s.pqPeerEncapKey = nil
+		}
+		if pqDecapKey != nil {
+			s.pqDecapKey = pqDecapKey
+		}
+		s.pqHeader = pqHeader
+		s.pqSteps++
+	}
+
 	return nil
 }
 
-func axolotlEncryptMessage(s *State, msg []byte, randomData io.Reader) ([]byte, error) {
+func axolotlEncryptMessage(s *State, msg, ad []byte, randomData io.Reader) ([]byte, error) {
+	b, messageKey, err := encryptMessage(s, msg, ad, randomData)
+	zeroKey(messageKey)
+	return b, err
+}
+
+//encryptMessage encrypts msg and returns the message together with its message key
+func encryptMessage(s *State, msg, ad []byte, randomData io.Reader) ([]byte, key, error) {
 	var err error
 	var headerCipher cipher.AEAD
 	var messageCipher cipher.AEAD
 
+	lockRoot(s)
 	if s.ratchetFlag {
 		err = dhRatchetGenerateKeys(s, randomData)
-		if err != nil {
-			return nil, err
-		}
+	}
+	unlockRoot(s)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	headerCipher, err = s.streamCipher(s.hdrKeyS)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	messageKey := s.hmac(s.chainKeyS).Sum([]byte{0})
 
 	messageCipher, err = s.streamCipher(messageKey)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	m := &message{}
+	m := &message{version: wireVersion1, suiteID: s.suiteID}
+	if s.padding > 0 {
+		m.flags |= wireFlagPadded
+		msg = pad(msg, int(s.padding))
+	}
 
 	m.headerNonceSize = byte(headerCipher.NonceSize())
     
@@ -104,25 +138,22 @@ func axolotlEncryptMessage(s *State, msg []byte, randomData io.Reader) ([]byte,
 	m.messageNonce = make([]byte, m.messageNonceSize)
 	_, err = io.ReadFull(randomData, m.messageNonce)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	//Set the header plaintext
-	m.headerData = make([]byte, 8+len(s.dhParams.PublicKey))
-	binary.BigEndian.PutUint32(m.headerData[0:4], s.msgNumS)
-	binary.BigEndian.PutUint32(m.headerData[4:8], s.prevMsgNumS)
-	copy(m.headerData[8:], s.dhParams.PublicKey)
+	m.headerData = encodeHeader(s)
 
 	//Encrypt the header
-	m.headerData = headerCipher.Seal(nil, m.headerNonce, m.headerData, []byte{})
+	m.headerData = headerCipher.Seal(nil, m.headerNonce, m.headerData, headerAD(ad, m))
 
-	//Encrypt the message
-	m.messageData = messageCipher.Seal(nil, m.messageNonce, msg, []byte{})
+	//Encrypt the message, binding it to the encrypted header
+	m.messageData = messageCipher.Seal(nil, m.messageNonce, msg, messageAD(ad, m))
 
 	m.headerLength = uint32(len(m.headerData))
 	m.messageLength = uint32(len(m.messageData))
 
 	s.msgNumS++
 	s.chainKeyS = s.hmac(s.chainKeyS).Sum([]byte{1})
-	return serialize(m), nil
+	return serialize(m), messageKey, nil
 }
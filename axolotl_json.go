@@ -0,0 +1,281 @@
+package axolotl
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/arcpop/ecdh"
+	"time"
+)
+
+//stateJSONVersion is the version of the JSON representation
+const stateJSONVersion = 1
+
+//hexBytes is a byte slice which is hex encoded in JSON
+type hexBytes []byte
+
+//MarshalText returns the hex encoding of h
+func (h hexBytes) MarshalText() ([]byte, error) {
+	b := make([]byte, hex.EncodedLen(len(h)))
+	hex.Encode(b, h)
+	return b, nil
+}
+
+//UnmarshalText decodes the hex encoded text into h
+func (h *hexBytes) UnmarshalText(text []byte) error {
+	b := make([]byte, hex.DecodedLen(len(text)))
+	_, err := hex.Decode(b, text)
+	if err != nil {
+		return err
+	}
+	*h = b
+	return nil
+}
+
+//StateJSON is the JSON representation of a State
+//Algorithms are given by their registered names. Secrets is nil if the state was exported redacted.
+type StateJSON struct {
+	Version         int               `json:"version"`
+	Suite           string            `json:"suite"`
+	Curve           string            `json:"curve"`
+	Cipher          string            `json:"cipher"`
+	KDF             string            `json:"kdf"`
+	MAC             string            `json:"mac"`
+	SenderSide      bool              `json:"sender_side"`
+	RatchetFlag     bool              `json:"ratchet_flag"`
+	MsgNumS         uint32            `json:"msg_num_s"`
+	MsgNumR         uint32            `json:"msg_num_r"`
+	PrevMsgNumS     uint32            `json:"prev_msg_num_s"`
+	RatchetSteps    uint32            `json:"ratchet_steps"`
+	DHPublicKey     hexBytes          `json:"dh_public_key,omitempty"`
+	PeerDHPublicKey hexBytes          `json:"peer_dh_public_key,omitempty"`
+	SkippedKeys     int               `json:"skipped_keys"`
+	ReplayWindow    []SeenChainJSON   `json:"replay_window,omitempty"`
+	Limits          Limits            `json:"limits"`
+	Padding         uint32            `json:"padding,omitempty"`
+	PQ              *PQStateJSON      `json:"pq,omitempty"`
+	Secrets         *StateSecretsJSON `json:"secrets,omitempty"`
+}
+
+//PQStateJSON is the JSON representation of the post-quantum ratchet of a State
+type PQStateJSON struct {
+	KEM                  string   `json:"kem"`
+	Interval             uint32   `json:"interval"`
+	Steps                uint32   `json:"steps"`
+	PeerEncapsulationKey hexBytes `json:"peer_encapsulation_key,omitempty"`
+	Header               hexBytes `json:"header,omitempty"`
+	HasDecapsulationKey  bool     `json:"has_decapsulation_key"`
+}
+
+//StateSecretsJSON holds the secret keys of a State
+type StateSecretsJSON struct {
+	RootKey            hexBytes         `json:"root_key"`
+	HeaderNonceSource  hexBytes         `json:"header_nonce_source,omitempty"`
+	HdrKeyS            hexBytes         `json:"hdr_key_s,omitempty"`
+	HdrKeyR            hexBytes         `json:"hdr_key_r,omitempty"`
+	NextHdrKeyS        hexBytes         `json:"next_hdr_key_s,omitempty"`
+	NextHdrKeyR        hexBytes         `json:"next_hdr_key_r,omitempty"`
+	ChainKeyS          hexBytes         `json:"chain_key_s,omitempty"`
+	ChainKeyR          hexBytes         `json:"chain_key_r,omitempty"`
+	DHPrivateKey       hexBytes         `json:"dh_private_key,omitempty"`
+	PQDecapsulationKey hexBytes         `json:"pq_decapsulation_key,omitempty"`
+	SkippedKeys        []SkippedKeyJSON `json:"skipped_keys,omitempty"`
+}
+
+//SeenChainJSON lists the decrypted messages of a receiving chain kept in the replay window
+type SeenChainJSON struct {
+	RatchetKey hexBytes          `json:"ratchet_key"`
+	Messages   []SeenMessageJSON `json:"messages"`
+}
+
+//SeenMessageJSON holds the message number and the digests of header and body of a decrypted message
+type SeenMessageJSON struct {
+	N      uint32   `json:"n"`
+	Header hexBytes `json:"header"`
+	Body   hexBytes `json:"body"`
+}
+
+//SkippedKeyJSON is the JSON representation of a SkippedKey
+type SkippedKeyJSON struct {
+	HeaderKey   hexBytes  `json:"header_key"`
+	MessageKey  hexBytes  `json:"message_key"`
+	N           uint32    `json:"n"`
+	RatchetStep uint32    `json:"ratchet_step"`
+	Stored      time.Time `json:"stored"`
+}
+
+func skippedKeysToJSON(keys []SkippedKey) []SkippedKeyJSON {
+	var j []SkippedKeyJSON
+	for _, k := range keys {
+		j = append(j, SkippedKeyJSON{k.HeaderKey, k.MessageKey, k.N, k.RatchetStep, k.Stored})
+	}
+	return j
+}
+
+func skippedKeysFromJSON(j []SkippedKeyJSON) []SkippedKey {
+	var keys []SkippedKey
+	for _, k := range j {
+		keys = append(keys, SkippedKey{k.HeaderKey, k.MessageKey, k.N, k.RatchetStep, k.Stored})
+	}
+	return keys
+}
+
+func stateToJSON(s *State, includeSecrets bool) (*StateJSON, error) {
+	j := &StateJSON{
+		Version:         stateJSONVersion,
+		Suite:           stateSuite(s).Name,
+		Curve:           algorithmName(curveNames, s.CurveParam),
+		Cipher:          algorithmName(cipherNames, s.StreamCipher),
+		KDF:             algorithmName(kdfNames, s.HKDF),
+		MAC:             algorithmName(macNames, s.HMAC),
+		SenderSide:      s.SenderSide,
+		RatchetFlag:     s.ratchetFlag,
+		MsgNumS:         s.msgNumS,
+		MsgNumR:         s.msgNumR,
+		PrevMsgNumS:     s.prevMsgNumS,
+		RatchetSteps:    s.ratchetSteps,
+		PeerDHPublicKey: hexBytes(s.dhPublicKey),
+		Limits:          s.Limits,
+		Padding:         s.padding,
+	}
+	if s.dhParams != nil {
+		j.DHPublicKey = s.dhParams.PublicKey
+	}
+	n, err := s.skippedKeys.Len()
+	if err != nil {
+		return nil, err
+	}
+	j.SkippedKeys = n
+	for _, c := range s.seen {
+		sc := SeenChainJSON{RatchetKey: c.ratchetKey}
+		for _, m := range c.messages {
+			sc.Messages = append(sc.Messages, SeenMessageJSON{m.n, append(hexBytes{}, m.header[:]...), append(hexBytes{}, m.body[:]...)})
+		}
+		j.ReplayWindow = append(j.ReplayWindow, sc)
+	}
+	if s.pqRatchet {
+		j.PQ = &PQStateJSON{
+			KEM:                  algorithmName(kemNames, s.pqKEM),
+			Interval:             s.pqInterval,
+			Steps:                s.pqSteps,
+			PeerEncapsulationKey: s.pqPeerEncapKey,
+			Header:               s.pqHeader,
+			HasDecapsulationKey:  s.pqDecapKey != nil,
+		}
+	}
+	if !includeSecrets {
+		return j, nil
+	}
+	j.Secrets = &StateSecretsJSON{
+		RootKey:            hexBytes(s.rootKey),
+		HeaderNonceSource:  s.headerNonceSource,
+		HdrKeyS:            hexBytes(s.hdrKeyS),
+		HdrKeyR:            hexBytes(s.hdrKeyR),
+		NextHdrKeyS:        hexBytes(s.nextHdrKeyS),
+		NextHdrKeyR:        hexBytes(s.nextHdrKeyR),
+		ChainKeyS:          hexBytes(s.chainKeyS),
+		ChainKeyR:          hexBytes(s.chainKeyR),
+		PQDecapsulationKey: s.pqDecapKey,
+	}
+	if s.dhParams != nil {
+		j.Secrets.DHPrivateKey = s.dhParams.PrivateKey
+	}
+	//Only keys of the in-memory store are exported, see SetSkippedKeyStore
+	if m, ok := s.skippedKeys.(*MemorySkippedKeyStore); ok {
+		j.Secrets.SkippedKeys = skippedKeysToJSON(m.all())
+	}
+	return j, nil
+}
+
+func stateFromJSON(j *StateJSON) (*State, error) {
+	if j.Version != stateJSONVersion {
+		return nil, ErrUnsupportedVersion
+	}
+	if j.Secrets == nil || j.Padding > maxPadding {
+		return nil, ErrInvalidState
+	}
+	s := &State{
+		SenderSide:        j.SenderSide,
+		ratchetFlag:       j.RatchetFlag,
+		msgNumS:           j.MsgNumS,
+		msgNumR:           j.MsgNumR,
+		prevMsgNumS:       j.PrevMsgNumS,
+		ratchetSteps:      j.RatchetSteps,
+		dhPublicKey:       dhkey(j.PeerDHPublicKey),
+		Limits:            j.Limits,
+		padding:           j.Padding,
+		rootKey:           key(j.Secrets.RootKey),
+		headerNonceSource: j.Secrets.HeaderNonceSource,
+		hdrKeyS:           key(j.Secrets.HdrKeyS),
+		hdrKeyR:           key(j.Secrets.HdrKeyR),
+		nextHdrKeyS:       key(j.Secrets.NextHdrKeyS),
+		nextHdrKeyR:       key(j.Secrets.NextHdrKeyR),
+		chainKeyS:         key(j.Secrets.ChainKeyS),
+		chainKeyR:         key(j.Secrets.ChainKeyR),
+		dhParams:          &ecdh.ECDH{PrivateKey: j.Secrets.DHPrivateKey, PublicKey: j.DHPublicKey},
+	}
+	var err error
+	for _, a := range []struct {
+		names *algorithmNames
+		name  string
+		id    *uint8
+	}{
+		{curveNames, j.Curve, &s.CurveParam},
+		{cipherNames, j.Cipher, &s.StreamCipher},
+		{kdfNames, j.KDF, &s.HKDF},
+		{macNames, j.MAC, &s.HMAC},
+	} {
+		*a.id, err = algorithmID(a.names, a.name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if j.PQ != nil {
+		s.pqRatchet = true
+		s.pqKEM, err = algorithmID(kemNames, j.PQ.KEM)
+		if err != nil {
+			return nil, ErrUnknownKEM
+		}
+		s.pqInterval = j.PQ.Interval
+		s.pqSteps = j.PQ.Steps
+		s.pqPeerEncapKey = j.PQ.PeerEncapsulationKey
+		s.pqHeader = j.PQ.Header
+		s.pqDecapKey = j.Secrets.PQDecapsulationKey
+	}
+	skipped := NewMemorySkippedKeyStore()
+	for _, k := range skippedKeysFromJSON(j.Secrets.SkippedKeys) {
+		skipped.Put(k)
+	}
+	s.skippedKeys = skipped
+	for _, c := range j.ReplayWindow {
+		sc := seenChain{ratchetKey: c.RatchetKey}
+		for _, m := range c.Messages {
+			if len(m.Header) != digestSize || len(m.Body) != digestSize {
+				return nil, ErrInvalidState
+			}
+			seen := seenMessage{n: m.N}
+			copy(seen.header[:], m.Header)
+			copy(seen.body[:], m.Body)
+			sc.messages = append(sc.messages, seen)
+		}
+		s.seen = append(s.seen, sc)
+	}
+	return s, finishState(s)
+}
+
+func axolotlExportJSON(s *State, includeSecrets bool) ([]byte, error) {
+	j, err := stateToJSON(s, includeSecrets)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(j, "", "\t")
+}
+
+func axolotlImportJSON(data []byte) (*State, error) {
+	//Limits missing from the data keep their defaults
+	j := &StateJSON{Limits: DefaultLimits}
+	err := json.Unmarshal(data, j)
+	if err != nil {
+		return nil, err
+	}
+	return stateFromJSON(j)
+}
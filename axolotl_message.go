@@ -5,7 +5,30 @@ import (
 	"io"
 )
 
+//Wire format versions, legacy messages carry no envelope
+const (
+	wireVersionLegacy = 0
+	wireVersion1      = 1
+)
+
+//wireMagic starts every versioned message. Legacy messages start with the
+//header nonce size which is never 0, so the first byte tells both layouts apart.
+var wireMagic = [3]byte{0x00, 'A', 'X'}
+
+//envelopeSize is the size of magic, version, suite id and flags
+const envelopeSize = 7
+
+//wireFlagPadded marks a message whose plaintext has been padded by pad
+const wireFlagPadded = 1 << 0
+
+//knownWireFlags masks the flags this implementation understands, messages with
+//other flags set are rejected
+const knownWireFlags = wireFlagPadded
+
 type message struct {
+	version          byte
+	suiteID          uint16
+	flags            byte
 	headerNonceSize  byte
 	messageNonceSize byte
 	headerLength     uint32
@@ -16,46 +39,187 @@ type message struct {
 	messageData      []byte
 }
 
+//encodeHeader returns the header plaintext for the next message of the sending chain.
+//With the post-quantum ratchet the DH public key is length prefixed and followed
+//by the KEM header extension of the chain.
+func encodeHeader(s *State) []byte {
+	if !s.pqRatchet {
+		b := make([]byte, 8+len(s.dhParams.PublicKey))
+		binary.BigEndian.PutUint32(b[0:4], s.msgNumS)
+		binary.BigEndian.PutUint32(b[4:8], s.prevMsgNumS)
+		copy(b[8:], s.dhParams.PublicKey)
+		return b
+	}
+	pqHeader := s.pqHeader
+	if pqHeader == nil {
+		pqHeader = []byte{0}
+	}
+	b := make([]byte, 10, 10+len(s.dhParams.PublicKey)+len(pqHeader))
+	binary.BigEndian.PutUint32(b[0:4], s.msgNumS)
+	binary.BigEndian.PutUint32(b[4:8], s.prevMsgNumS)
+	binary.BigEndian.PutUint16(b[8:10], uint16(len(s.dhParams.PublicKey)))
+	b = append(b, s.dhParams.PublicKey...)
+	return append(b, pqHeader...)
+}
+
+//decodeHeader splits a decrypted header into the message number, the previous
+//chain length, the DH public key and the post-quantum header extension
+func decodeHeader(s *State, hdr []byte) (uint32, uint32, []byte, []byte, error) {
+	if len(hdr) < 8 {
+		return 0, 0, nil, nil, ErrMalformedMessage
+	}
+	n := binary.BigEndian.Uint32(hdr[0:4])
+	pn := binary.BigEndian.Uint32(hdr[4:8])
+	if !s.pqRatchet {
+		return n, pn, hdr[8:], nil, nil
+	}
+	if len(hdr) < 10 {
+		return 0, 0, nil, nil, ErrMalformedMessage
+	}
+	dhLen := int(binary.BigEndian.Uint16(hdr[8:10]))
+	if len(hdr) < 10+dhLen {
+		return 0, 0, nil, nil, ErrMalformedMessage
+	}
+	return n, pn, hdr[10 : 10+dhLen], hdr[10+dhLen:], nil
+}
+
+//envelope returns the versioned envelope of the message or nil for the legacy layout
+func (m *message) envelope() []byte {
+	if m.version == wireVersionLegacy {
+		return nil
+	}
+	b := make([]byte, envelopeSize)
+	copy(b[0:3], wireMagic[:])
+	b[3] = m.version
+	binary.BigEndian.PutUint16(b[4:6], m.suiteID)
+	b[6] = m.flags
+	return b
+}
+
+func parseEnvelope(m *message, b []byte) error {
+	if b[0] != wireMagic[0] || b[1] != wireMagic[1] || b[2] != wireMagic[2] {
+		return ErrMalformedMessage
+	}
+	m.version = b[3]
+	if m.version != wireVersion1 {
+		return ErrUnsupportedVersion
+	}
+	m.suiteID = binary.BigEndian.Uint16(b[4:6])
+	m.flags = b[6]
+	if m.flags&^knownWireFlags != 0 {
+		return ErrUnsupportedVersion
+	}
+	return nil
+}
+
+//pad appends a 0x80 byte and zeros to msg up to the next multiple of blockSize
+func pad(msg []byte, blockSize int) []byte {
+	n := len(msg) + 1
+	n += (blockSize - n%blockSize) % blockSize
+	b := make([]byte, n)
+	copy(b, msg)
+	b[len(msg)] = 0x80
+	return b
+}
+
+//unpad removes the padding appended by pad
+func unpad(b []byte) ([]byte, error) {
+	i := len(b) - 1
+	for i >= 0 && b[i] == 0 {
+		i--
+	}
+	if i < 0 || b[i] != 0x80 {
+		return nil, ErrMalformedMessage
+	}
+	return b[:i], nil
+}
+
+//headerAD returns the associated data authenticated with the header, the
+//envelope is covered so version, suite and flags cannot be altered
+func headerAD(ad []byte, m *message) []byte {
+	env := m.envelope()
+	if env == nil {
+		return ad
+	}
+	return append(env, ad...)
+}
+
+//messageAD returns the associated data authenticated with the message body.
+//It consists of the envelope and the length prefixed caller supplied data
+//followed by the header nonce and the encrypted header. Legacy messages only
+//authenticate the caller supplied data, as the first releases did.
+func messageAD(ad []byte, m *message) []byte {
+	if m.version == wireVersionLegacy {
+		return ad
+	}
+	env := m.envelope()
+	b := make([]byte, len(env)+4, len(env)+4+len(ad)+len(m.headerNonce)+len(m.headerData))
+	copy(b, env)
+	binary.BigEndian.PutUint32(b[len(env):], uint32(len(ad)))
+	b = append(b, ad...)
+	b = append(b, m.headerNonce...)
+	return append(b, m.headerData...)
+}
+
 func serialize(m *message) []byte {
 	m.headerNonceSize = byte(len(m.headerNonce))
 	m.messageNonceSize = byte(len(m.messageNonce))
 	m.headerLength = uint32(len(m.headerData))
 	m.messageLength = uint32(len(m.messageData))
-	b := make([]byte, m.headerLength+m.messageLength+uint32(m.headerNonceSize)+uint32(m.messageNonceSize)+10)
-	b[0] = m.headerNonceSize
-	b[1] = m.messageNonceSize
-	binary.BigEndian.PutUint32(b[2:6], m.headerLength)
-	binary.BigEndian.PutUint32(b[6:10], m.messageLength)
-
-	tmp := uint32(10)
-	copy(b[tmp:tmp+uint32(m.headerNonceSize)], m.headerNonce)
-
-	tmp += uint32(m.headerNonceSize)
-	copy(b[tmp:tmp+uint32(m.messageNonceSize)], m.messageNonce)
-
-	tmp += uint32(m.messageNonceSize)
-	copy(b[tmp:tmp+m.headerLength], m.headerData)
+	env := m.envelope()
+	b := make([]byte, len(env)+10, len(env)+10+int(m.headerNonceSize)+int(m.messageNonceSize)+len(m.headerData)+len(m.messageData))
+	copy(b, env)
+	body := b[len(env):]
+	body[0] = m.headerNonceSize
+	body[1] = m.messageNonceSize
+	binary.BigEndian.PutUint32(body[2:6], m.headerLength)
+	binary.BigEndian.PutUint32(body[6:10], m.messageLength)
 
-	tmp += m.headerLength
-	copy(b[tmp:tmp+m.messageLength], m.messageData)
+	b = append(b, m.headerNonce...)
+	b = append(b, m.messageNonce...)
+	b = append(b, m.headerData...)
+	return append(b, m.messageData...)
+}
 
-	return b
+//checkSize returns a MessageTooLargeError if the lengths claimed by m exceed the limits
+func checkSize(m *message, l Limits) error {
+	if l.MaxHeaderSize > 0 && m.headerLength > l.MaxHeaderSize {
+		return &MessageTooLargeError{"header", m.headerLength, l.MaxHeaderSize}
+	}
+	if l.MaxMessageSize > 0 && m.messageLength > l.MaxMessageSize {
+		return &MessageTooLargeError{"message", m.messageLength, l.MaxMessageSize}
+	}
+	return nil
 }
 
-func deserialize(b []byte) (*message, error) {
+func deserialize(b []byte, l Limits) (*message, error) {
+	m := &message{}
+	if len(b) > 0 && b[0] == wireMagic[0] {
+		if len(b) < envelopeSize {
+			return nil, ErrMalformedMessage
+		}
+		err := parseEnvelope(m, b[0:envelopeSize])
+		if err != nil {
+			return nil, err
+		}
+		b = b[envelopeSize:]
+	}
 	if len(b) < 10 {
 		return nil, ErrMalformedMessage
 	}
 
-	m := &message{}
 	m.headerNonceSize = b[0]
 	m.messageNonceSize = b[1]
 	m.headerLength = binary.BigEndian.Uint32(b[2:6])
 	m.messageLength = binary.BigEndian.Uint32(b[6:10])
+	err := checkSize(m, l)
+	if err != nil {
+		return nil, err
+	}
 
-	totalLength := 10 + uint32(m.headerNonceSize) + uint32(m.messageNonceSize) + m.headerLength + m.messageLength
+	totalLength := 10 + uint64(m.headerNonceSize) + uint64(m.messageNonceSize) + uint64(m.headerLength) + uint64(m.messageLength)
 
-	if uint32(len(b)) < totalLength {
+	if uint64(len(b)) < totalLength {
 		return nil, ErrMalformedMessage
 	}
 
@@ -78,40 +242,79 @@ func deserialize(b []byte) (*message, error) {
 	return m, nil
 }
 
-func deserializeFromReader(rd io.Reader) (*message, error) {
-	var b [10]byte
+//readMessageData reads the next part of a message, it returns io.ErrUnexpectedEOF
+//if rd ends within the message so the read can be retried
+func readMessageData(rd io.Reader, b []byte) error {
+	_, err := io.ReadFull(rd, b)
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+//deserializeFromReader reads one message from rd, lengths beyond l are rejected
+//before their data is read. It returns io.EOF if rd ends before the message and
+//io.ErrUnexpectedEOF if it ends within.
+func deserializeFromReader(rd io.Reader, l Limits) (*message, error) {
+	var b [envelopeSize]byte
 
-	_, err := io.ReadFull(rd, b[:])
+	_, err := io.ReadFull(rd, b[0:1])
 	if err != nil {
 		return nil, err
 	}
 
 	m := &message{}
-	m.headerNonceSize = b[0]
-	m.messageNonceSize = b[1]
-	m.headerLength = binary.BigEndian.Uint32(b[2:6])
-	m.messageLength = binary.BigEndian.Uint32(b[6:10])
+	if b[0] == wireMagic[0] {
+		err = readMessageData(rd, b[1:envelopeSize])
+		if err != nil {
+			return nil, err
+		}
+		err = parseEnvelope(m, b[:])
+		if err != nil {
+			return nil, err
+		}
+		err = readMessageData(rd, b[0:1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var hb [10]byte
+	hb[0] = b[0]
+	err = readMessageData(rd, hb[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	m.headerNonceSize = hb[0]
+	m.messageNonceSize = hb[1]
+	m.headerLength = binary.BigEndian.Uint32(hb[2:6])
+	m.messageLength = binary.BigEndian.Uint32(hb[6:10])
+	err = checkSize(m, l)
+	if err != nil {
+		return nil, err
+	}
 
 	m.headerNonce = make([]byte, m.headerNonceSize)
-	_, err = io.ReadFull(rd, m.headerNonce)
+	err = readMessageData(rd, m.headerNonce)
 	if err != nil {
 		return nil, err
 	}
 
 	m.messageNonce = make([]byte, m.messageNonceSize)
-	_, err = io.ReadFull(rd, m.messageNonce)
+	err = readMessageData(rd, m.messageNonce)
 	if err != nil {
 		return nil, err
 	}
 
 	m.headerData = make([]byte, m.headerLength)
-	_, err = io.ReadFull(rd, m.headerData)
+	err = readMessageData(rd, m.headerData)
 	if err != nil {
 		return nil, err
 	}
 
 	m.messageData = make([]byte, m.messageLength)
-	_, err = io.ReadFull(rd, m.messageData)
+	err = readMessageData(rd, m.messageData)
 	if err != nil {
 		return nil, err
 	}
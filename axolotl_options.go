@@ -0,0 +1,216 @@
+package axolotl
+
+import (
+	"crypto/rand"
+	"github.com/arcpop/ecdh"
+	"io"
+	"time"
+)
+
+//maxPadding bounds the block size messages get padded to
+const maxPadding = 64 * 1024
+
+type options struct {
+	suite         Suite
+	masterKey     []byte
+	peerPublicKey []byte
+	keyPair       *ecdh.ECDH
+	random        io.Reader
+	limits        Limits
+	padding       uint32
+	clock         func() time.Time
+}
+
+func optionError(option string, err error) error {
+	return &ConfigError{Option: option, Err: err}
+}
+
+func withSuite(suite Suite) Option {
+	return func(o *options) error {
+		err := validateSuite(suite)
+		if err != nil {
+			return optionError("suite", err)
+		}
+		o.suite = suite
+		return nil
+	}
+}
+
+func withMasterKey(masterKey []byte) Option {
+	return func(o *options) error {
+		if len(masterKey) < minMasterKeyLength {
+			return optionError("master key", ErrInvalidKeyLength)
+		}
+		o.masterKey = masterKey
+		return nil
+	}
+}
+
+func withPeerPublicKey(publicKey []byte) Option {
+	return func(o *options) error {
+		if len(publicKey) == 0 {
+			return optionError("peer public key", ErrInvalidPublicKey)
+		}
+		o.peerPublicKey = publicKey
+		return nil
+	}
+}
+
+func withKeyPair(keyPair *ecdh.ECDH) Option {
+	return func(o *options) error {
+		if keyPair == nil || len(keyPair.PrivateKey) == 0 || len(keyPair.PublicKey) == 0 {
+			return optionError("key pair", ErrInvalidKeyPair)
+		}
+		o.keyPair = keyPair
+		return nil
+	}
+}
+
+func withRandom(random io.Reader) Option {
+	return func(o *options) error {
+		if random == nil {
+			return optionError("random", ErrInvalidOption)
+		}
+		o.random = random
+		return nil
+	}
+}
+
+func withLimits(limits Limits) Option {
+	return func(o *options) error {
+		if limits.MaxSkippedKeys < 0 || limits.MaxSkippedAge < 0 || limits.ReplayWindow < 0 {
+			return optionError("limits", ErrInvalidOption)
+		}
+		mergeLimits(&o.limits, limits)
+		return nil
+	}
+}
+
+//mergeLimits sets the non-zero fields of limits in l
+func mergeLimits(l *Limits, limits Limits) {
+	if limits.MaxSkip != 0 {
+		l.MaxSkip = limits.MaxSkip
+	}
+	if limits.MaxSkippedKeys != 0 {
+		l.MaxSkippedKeys = limits.MaxSkippedKeys
+	}
+	if limits.MaxSkippedAge != 0 {
+		l.MaxSkippedAge = limits.MaxSkippedAge
+	}
+	if limits.MaxSkippedRatchetSteps != 0 {
+		l.MaxSkippedRatchetSteps = limits.MaxSkippedRatchetSteps
+	}
+	if limits.MaxHeaderSize != 0 {
+		l.MaxHeaderSize = limits.MaxHeaderSize
+	}
+	if limits.MaxMessageSize != 0 {
+		l.MaxMessageSize = limits.MaxMessageSize
+	}
+	if limits.ReplayWindow != 0 {
+		l.ReplayWindow = limits.ReplayWindow
+	}
+}
+
+func withPadding(blockSize int) Option {
+	return func(o *options) error {
+		if blockSize < 1 || blockSize > maxPadding {
+			return optionError("padding", ErrInvalidOption)
+		}
+		o.padding = uint32(blockSize)
+		return nil
+	}
+}
+
+func withClock(clock func() time.Time) Option {
+	return func(o *options) error {
+		if clock == nil {
+			return optionError("clock", ErrInvalidOption)
+		}
+		o.clock = clock
+		return nil
+	}
+}
+
+func axolotlNew(role Role, opts []Option) (*State, error) {
+	o := &options{
+		suite:  SuiteX25519_SHA256_AESGCM256,
+		random: rand.Reader,
+		limits: DefaultLimits,
+		clock:  time.Now,
+	}
+	for _, opt := range opts {
+		err := opt(o)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.masterKey == nil {
+		return nil, optionError("master key", ErrMissingOption)
+	}
+
+	var s *State
+	var err error
+	switch role {
+	case RoleSender:
+		if o.keyPair != nil {
+			return nil, optionError("key pair", ErrInvalidOption)
+		}
+		if o.peerPublicKey == nil {
+			return nil, optionError("peer public key", ErrMissingOption)
+		}
+		s, err = axolotlNewS(o.suite.Curve, o.suite.Cipher, o.suite.KDF, o.suite.MAC, o.masterKey, o.peerPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		//The first message runs a DH ratchet step with the peer key, try it now
+		//with a fixed key pair, neither it nor the result is secret
+		params, err := s.dh.generate(s.hkdf([]byte("axolotl peer key check"), nil, nil))
+		if err != nil {
+			return nil, err
+		}
+		secret, err := s.dh.sharedSecret(params, o.peerPublicKey)
+		zeroKey(params.PrivateKey)
+		zeroKey(secret)
+		if err != nil {
+			return nil, optionError("peer public key", ErrInvalidPublicKey)
+		}
+	case RoleReceiver:
+		if o.peerPublicKey != nil {
+			return nil, optionError("peer public key", ErrInvalidOption)
+		}
+		if o.keyPair == nil {
+			return nil, optionError("key pair", ErrMissingOption)
+		}
+		s, err = axolotlNewR(o.suite.Curve, o.suite.Cipher, o.suite.KDF, o.suite.MAC, o.masterKey, o.keyPair)
+		if err != nil {
+			return nil, err
+		}
+		err = s.dh.checkKeyPair(o.keyPair)
+		if err != nil {
+			return nil, optionError("key pair", err)
+		}
+	default:
+		return nil, optionError("role", ErrInvalidOption)
+	}
+	s.Limits = o.limits
+	s.random = o.random
+	s.clock = o.clock
+	s.padding = o.padding
+	return s, nil
+}
+
+//randomSource returns the source of randomness of the state
+func (s *State) randomSource() io.Reader {
+	if s.random == nil {
+		return rand.Reader
+	}
+	return s.random
+}
+
+//now returns the current time of the clock of the state
+func (s *State) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock()
+}
@@ -1,271 +1,150 @@
 package axolotl
 
 import (
-	"container/list"
-	"encoding/binary"
-	"github.com/arcpop/ecdh"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
 	"io"
 	"os"
+	"path/filepath"
 )
 
+//A state file holds the versioned state followed by its SHA-256 checksum.
+//Files in the legacy layout carry no checksum and are only read by
+//axolotlMigrateLegacyState.
 func axolotlFromFile(fileName string) (*State, error) {
-	f, err := os.Open(fileName)
+	b, err := os.ReadFile(fileName)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-
-	var buf [32]byte
-	s := &State{}
-	_, err = io.ReadFull(f, buf[0:18])
-	if err != nil {
-		return nil, err
-	}
-
-	s.CurveParam = buf[0]
-	s.StreamCipher = buf[1]
-	s.HKDF = buf[2]
-	s.HMAC = buf[3]
-	s.SenderSide = buf[5] != 0
-	s.ratchetFlag = buf[6] != 0
-	s.msgNumS = binary.BigEndian.Uint32(buf[6:10])
-	s.msgNumR = binary.BigEndian.Uint32(buf[10:14])
-	s.prevMsgNumS = binary.BigEndian.Uint32(buf[14:18])
-
-	s.rootKey = make(key, 32)
-	_, err = io.ReadFull(f, s.rootKey)
-	if err != nil {
-		return nil, err
-	}
-    s.headerNonceSource = make([]byte, 32)
-    _, err = io.ReadFull(f, s.nextHdrKeyS)
-	if err != nil {
-		return nil, err
-	}
-	s.hdrKeyS = make(key, 32)
-	_, err = io.ReadFull(f, s.hdrKeyS)
-	if err != nil {
-		return nil, err
-	}
-	s.hdrKeyR = make(key, 32)
-	_, err = io.ReadFull(f, s.hdrKeyR)
-	if err != nil {
-		return nil, err
-	}
-	s.nextHdrKeyS = make(key, 32)
-	_, err = io.ReadFull(f, s.nextHdrKeyS)
-	if err != nil {
-		return nil, err
-	}
-	s.nextHdrKeyR = make(key, 32)
-	_, err = io.ReadFull(f, s.nextHdrKeyR)
-	if err != nil {
-		return nil, err
-	}
-	s.chainKeyS = make(key, 32)
-	_, err = io.ReadFull(f, s.chainKeyS)
-	if err != nil {
-		return nil, err
-	}
-	s.chainKeyR = make(key, 32)
-	_, err = io.ReadFull(f, s.chainKeyR)
-	if err != nil {
-		return nil, err
+	defer zeroKey(b)
+	if !bytes.HasPrefix(b, stateMagic[:]) || len(b) < sha256.Size {
+		return nil, ErrInvalidState
 	}
-	_, err = io.ReadFull(f, buf[0:12])
-	if err != nil {
-		return nil, err
+	data := b[:len(b)-sha256.Size]
+	sum := sha256.Sum256(data)
+	if subtle.ConstantTimeCompare(sum[:], b[len(data):]) != 1 {
+		return nil, ErrInvalidState
 	}
-	dhrsLen := binary.BigEndian.Uint32(buf[0:4])
-	dhrrLen := binary.BigEndian.Uint32(buf[4:8])
-	dhrpLen := binary.BigEndian.Uint32(buf[8:12])
-	s.dhParams = &ecdh.ECDH{Curve: dhCurves[s.CurveParam]()}
-	s.dhParams.PrivateKey = make(dhkey, dhrsLen)
-	_, err = io.ReadFull(f, s.dhParams.PrivateKey)
+	return readState(bytes.NewReader(data))
+}
+
+//axolotlMigrateLegacyState reads a file in the legacy layout, which has to end
+//exactly where the layout does
+func axolotlMigrateLegacyState(fileName string) (*State, error) {
+	b, err := os.ReadFile(fileName)
 	if err != nil {
 		return nil, err
 	}
-	s.dhParams.PublicKey = make(dhkey, dhrrLen)
-	_, err = io.ReadFull(f, s.dhParams.PublicKey)
-	if err != nil {
-		return nil, err
+	defer zeroKey(b)
+	if bytes.HasPrefix(b, stateMagic[:]) {
+		return nil, ErrInvalidState
 	}
-	s.dhPublicKey = make(dhkey, dhrpLen)
-	_, err = io.ReadFull(f, s.dhPublicKey)
-	if err != nil {
-		return nil, err
+	rd := bytes.NewReader(b)
+	s, err := readLegacyState(rd)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, ErrInvalidState
 	}
-
-	_, err = io.ReadFull(f, buf[0:4])
 	if err != nil {
 		return nil, err
 	}
-	numEntries := binary.BigEndian.Uint32(buf[0:4])
-	s.skippedKeys = list.New()
-	for i := 0; i < int(numEntries); i++ {
-		var sb [64]byte
-		_, err = io.ReadFull(f, sb[:])
-		if err != nil {
-			return nil, err
-		}
-		s.skippedKeys.PushBack(storedkey{sb[0:32], sb[32:64]})
+	if rd.Len() != 0 {
+		return nil, ErrInvalidState
 	}
-	s.streamCipher = streamCiphers[s.StreamCipher]
-	s.hkdf = hkdfs[s.HKDF]
-	s.hmac = hmacs[s.HMAC]
 	return s, nil
 }
 
-func saveBytes(f *os.File, b []byte) error {
-	n := 0
-	for n < 4 {
-		i, err := f.Write(b[n:])
-		if err != nil {
-			return err
-		}
-		n += i
-	}
-	return nil
-}
-
-func saveUint32(f *os.File, v uint32) error {
-	var b [4]byte
-	binary.BigEndian.PutUint32(b[:], v)
-	return saveBytes(f, b[:])
-}
-
-func saveUint8(f *os.File, v uint8) error {
-	var b [1]byte
-	b[0] = byte(v)
-	return saveBytes(f, b[:])
-}
-
-func saveBool(f *os.File, v bool) error {
-	var b [1]byte
-	b[0] = 0
-	if v {
-		b[0] = 1
-	}
-	return saveBytes(f, b[:])
-}
-
-func saveKey(f *os.File, k key) error {
-	var b [32]byte
-	copy(b[:], k)
-	return saveBytes(f, b[:])
-}
-
 func axolotlSaveTo(s *State, fileName string) error {
-	f, err := os.Open(fileName)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	err = saveUint8(f, s.CurveParam)
-	if err != nil {
-		return err
-	}
-	err = saveUint8(f, s.StreamCipher)
-	if err != nil {
-		return err
-	}
-	err = saveUint8(f, s.HKDF)
-	if err != nil {
-		return err
-	}
-	err = saveUint8(f, s.HMAC)
-	if err != nil {
-		return err
-	}
-	err = saveBool(f, s.SenderSide)
-	if err != nil {
-		return err
-	}
-	err = saveBool(f, s.ratchetFlag)
-	if err != nil {
-		return err
-	}
-	err = saveUint32(f, s.msgNumS)
-	if err != nil {
-		return err
-	}
-	err = saveUint32(f, s.msgNumR)
-	if err != nil {
-		return err
-	}
-	err = saveUint32(f, s.prevMsgNumS)
-	if err != nil {
-		return err
-	}
-	err = saveKey(f, s.rootKey)
-	if err != nil {
-		return err
-	}
-	err = saveKey(f, s.headerNonceSource)
-	if err != nil {
-		return err
-	}
-	err = saveKey(f, s.hdrKeyS)
+	var buf bytes.Buffer
+	err := writeState(s, &buf)
 	if err != nil {
 		return err
 	}
-	err = saveKey(f, s.hdrKeyR)
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+	defer zeroKey(buf.Bytes())
+	return writeFileAtomic(fileName, buf.Bytes())
+}
+
+//writeFileAtomic replaces the file with b so that it holds either the old or the
+//new content after a crash. The data is written to a temporary file in the same
+//directory which gets synced and renamed over the file, then the directory is
+//synced so the rename is durable.
+func writeFileAtomic(fileName string, b []byte) error {
+	err := writeFileRenamed(fileName, b)
 	if err != nil {
 		return err
 	}
-	err = saveKey(f, s.nextHdrKeyS)
+	return syncDir(filepath.Dir(fileName))
+}
+
+//writeFileRenamed writes b to a synced temporary file and renames it to
+//fileName, the directory has to be synced afterwards to make the rename durable
+func writeFileRenamed(fileName string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp-")
 	if err != nil {
 		return err
 	}
-	err = saveKey(f, s.nextHdrKeyR)
-	if err != nil {
-		return err
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
 	}
-	err = saveKey(f, s.chainKeyS)
-	if err != nil {
-		return err
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
-	err = saveKey(f, s.chainKeyR)
-	if err != nil {
-		return err
+	if err == nil {
+		err = os.Rename(f.Name(), fileName)
 	}
-	err = saveUint32(f, uint32(len(s.dhParams.PrivateKey)))
 	if err != nil {
+		os.Remove(f.Name())
 		return err
 	}
-	err = saveUint32(f, uint32(len(s.dhParams.PublicKey)))
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
 		return err
 	}
-	err = saveUint32(f, uint32(len(s.dhPublicKey)))
+	defer d.Close()
+	return d.Sync()
+}
+
+func axolotlMarshalBinary(s *State) ([]byte, error) {
+	var buf bytes.Buffer
+	err := writeState(s, &buf)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = saveBytes(f, s.dhParams.PrivateKey)
+	return buf.Bytes(), nil
+}
+
+func axolotlUnmarshalBinary(s *State, data []byte) error {
+	rd := bytes.NewReader(data)
+	n, err := readState(rd)
 	if err != nil {
 		return err
 	}
-	err = saveBytes(f, s.dhParams.PublicKey)
-	if err != nil {
-		return err
+	if rd.Len() != 0 {
+		return ErrInvalidState
 	}
-	err = saveBytes(f, s.dhPublicKey)
-	if err != nil {
-		return err
+	//The runtime configuration is not part of the encoding, keep the one of s.
+	//Stores other than the memory store hold their keys themselves.
+	n.random, n.clock, n.rootLock = s.random, s.clock, s.rootLock
+	if _, ok := s.skippedKeys.(*MemorySkippedKeyStore); !ok && s.skippedKeys != nil {
+		n.skippedKeys = s.skippedKeys
 	}
-	err = saveUint32(f, uint32(s.skippedKeys.Len()))
+	*s = *n
+	return nil
+}
+
+func axolotlWriteTo(s *State, w io.Writer) (int64, error) {
+	b, err := axolotlMarshalBinary(s)
 	if err != nil {
-		return err
-	}
-	for e := s.skippedKeys.Front(); e != nil; e = e.Next() {
-		err = saveBytes(f, e.Value.(storedkey)[0])
-		if err != nil {
-			return err
-		}
-		err = saveBytes(f, e.Value.(storedkey)[1])
-		if err != nil {
-			return err
-		}
+		return 0, err
 	}
-	return nil
+	defer zeroKey(b)
+	n, err := w.Write(b)
+	return int64(n), err
 }
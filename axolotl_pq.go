@@ -0,0 +1,85 @@
+package axolotl
+
+import (
+	"io"
+)
+
+//Flags in the post-quantum header extension
+const (
+	pqFlagEncapsulationKey = 1 << iota
+	pqFlagCiphertext
+)
+
+func axolotlEnablePQRatchet(s *State, KEM uint8, interval uint32) error {
+	k, ok := kems[KEM]
+	if !ok {
+		return ErrUnknownKEM
+	}
+	if interval == 0 {
+		interval = 1
+	}
+	s.pqRatchet = true
+	s.pqKEM = KEM
+	s.pqInterval = interval
+	s.kem = k
+	return nil
+}
+
+//pqRatchetSend performs the KEM part of a sending DH ratchet step.
+//If the peer offered an encapsulation key it is answered with a ciphertext, the
+//resulting shared secret gets mixed into the root key. Every pqInterval steps a
+//new encapsulation key is offered as long as no earlier one is unanswered.
+//It returns the shared secret, the header extension sent with every message of
+//the new chain and the decapsulation key to keep for the peer's answer.
+func pqRatchetSend(s *State, randomData io.Reader) ([]byte, []byte, []byte, error) {
+	var ss, ct, dk, ek []byte
+	var err error
+	ext := []byte{0}
+	if s.pqPeerEncapKey != nil {
+		ss, ct, err = s.kem.encapsulate(s.pqPeerEncapKey, randomData)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		ext[0] |= pqFlagCiphertext
+	}
+	if s.pqDecapKey == nil && s.pqSteps%s.pqInterval == 0 {
+		dk, ek, err = s.kem.generate(randomData)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		ext[0] |= pqFlagEncapsulationKey
+	}
+	ext = append(ext, ek...)
+	ext = append(ext, ct...)
+	return ss, ext, dk, nil
+}
+
+//pqRatchetReceive parses the header extension of a new receiving chain.
+//It returns the shared secret to mix into the root key and the encapsulation
+//key offered by the peer, both are nil if the extension does not carry them.
+func pqRatchetReceive(s *State, ext []byte) ([]byte, []byte, error) {
+	var ss, ek []byte
+	if len(ext) < 1 {
+		return nil, nil, ErrMalformedMessage
+	}
+	flags := ext[0]
+	ext = ext[1:]
+	if flags&pqFlagEncapsulationKey != 0 {
+		if len(ext) < s.kem.encapsulationKeySize {
+			return nil, nil, ErrMalformedMessage
+		}
+		ek = ext[:s.kem.encapsulationKeySize]
+		ext = ext[s.kem.encapsulationKeySize:]
+	}
+	if flags&pqFlagCiphertext != 0 {
+		if len(ext) != s.kem.ciphertextSize || s.pqDecapKey == nil {
+			return nil, nil, ErrMalformedMessage
+		}
+		var err error
+		ss, err = s.kem.decapsulate(s.pqDecapKey, ext)
+		if err != nil {
+			return nil, nil, ErrMalformedMessage
+		}
+	}
+	return ss, ek, nil
+}
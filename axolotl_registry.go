@@ -0,0 +1,212 @@
+package axolotl
+
+import (
+	"crypto/cipher"
+	"github.com/arcpop/ecdh"
+	"hash"
+	"io"
+	"sync"
+)
+
+//algorithmNames maps the ids of one kind of algorithm to their names and back
+type algorithmNames struct {
+	byID   map[uint8]string
+	byName map[string]uint8
+}
+
+func newAlgorithmNames(names map[uint8]string) *algorithmNames {
+	n := &algorithmNames{byID: names, byName: make(map[string]uint8, len(names))}
+	for id, name := range names {
+		n.byName[name] = id
+	}
+	return n
+}
+
+func (n *algorithmNames) check(id uint8, name string) error {
+	if name == "" {
+		return ErrInvalidAlgorithm
+	}
+	if _, ok := n.byID[id]; ok {
+		return ErrAlgorithmRegistered
+	}
+	if _, ok := n.byName[name]; ok {
+		return ErrAlgorithmRegistered
+	}
+	return nil
+}
+
+func (n *algorithmNames) add(id uint8, name string) {
+	n.byID[id] = name
+	n.byName[name] = id
+}
+
+//registryLock guards the algorithm maps in axolotl_data.go and the names below
+var registryLock sync.RWMutex
+
+var cipherNames = newAlgorithmNames(map[uint8]string{
+	AES_GCM_128:        "AES-128-GCM",
+	AES_GCM_192:        "AES-192-GCM",
+	AES_GCM_256:        "AES-256-GCM",
+	CHACHA20_POLY1305:  "ChaCha20-Poly1305",
+	XCHACHA20_POLY1305: "XChaCha20-Poly1305",
+})
+
+var curveNames = newAlgorithmNames(map[uint8]string{
+	CurveP224:   "P-224",
+	CurveP256:   "P-256",
+	CurveP384:   "P-384",
+	CurveP521:   "P-521",
+	CurveX25519: "X25519",
+	CurveX448:   "X448",
+})
+
+var kdfNames = newAlgorithmNames(map[uint8]string{
+	HKDF_SHA_256:  "HKDF-SHA-256",
+	HKDF_SHA_384:  "HKDF-SHA-384",
+	HKDF_SHA_512:  "HKDF-SHA-512",
+	HKDF_SHA3_256: "HKDF-SHA3-256",
+	HKDF_SHA3_384: "HKDF-SHA3-384",
+	HKDF_SHA3_512: "HKDF-SHA3-512",
+
+	HKDF_SHA_512_COMPAT: "HKDF-SHA-512-compat",
+})
+
+var macNames = newAlgorithmNames(map[uint8]string{
+	HMAC_SHA_256:  "HMAC-SHA-256",
+	HMAC_SHA_384:  "HMAC-SHA-384",
+	HMAC_SHA_512:  "HMAC-SHA-512",
+	HMAC_SHA3_256: "HMAC-SHA3-256",
+	HMAC_SHA3_384: "HMAC-SHA3-384",
+	HMAC_SHA3_512: "HMAC-SHA3-512",
+
+	HMAC_SHA_512_COMPAT: "HMAC-SHA-512-compat",
+})
+
+var kemNames = newAlgorithmNames(map[uint8]string{
+	ML_KEM_768:  "ML-KEM-768",
+	ML_KEM_1024: "ML-KEM-1024",
+})
+
+func registerCipher(id uint8, name string, newAEAD func(key []byte) (cipher.AEAD, error)) error {
+	if newAEAD == nil {
+		return ErrInvalidAlgorithm
+	}
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	err := cipherNames.check(id, name)
+	if err != nil {
+		return err
+	}
+	cipherNames.add(id, name)
+	streamCiphers[id] = newAEAD
+	return nil
+}
+
+func registerCurve(id uint8, name string, generate func(randomData io.Reader) (*ecdh.ECDH, error), sharedSecret func(params *ecdh.ECDH, publicKey []byte) ([]byte, error)) error {
+	if generate == nil || sharedSecret == nil {
+		return ErrInvalidAlgorithm
+	}
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	err := curveNames.check(id, name)
+	if err != nil {
+		return err
+	}
+	curveNames.add(id, name)
+	dhCurves[id] = dhCurve{generate: generate, sharedSecret: sharedSecret}
+	return nil
+}
+
+func registerKDF(id uint8, name string, kdf func(secret, salt, info []byte) io.Reader) error {
+	if kdf == nil {
+		return ErrInvalidAlgorithm
+	}
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	err := kdfNames.check(id, name)
+	if err != nil {
+		return err
+	}
+	kdfNames.add(id, name)
+	hkdfs[id] = kdf
+	return nil
+}
+
+func registerMAC(id uint8, name string, mac func(key []byte) hash.Hash) error {
+	if mac == nil {
+		return ErrInvalidAlgorithm
+	}
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	err := macNames.check(id, name)
+	if err != nil {
+		return err
+	}
+	macNames.add(id, name)
+	hmacs[id] = mac
+	return nil
+}
+
+func lookupCurve(id uint8) (dhCurve, error) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	c, ok := dhCurves[id]
+	if !ok {
+		return dhCurve{}, ErrUnknownAlgorithm
+	}
+	return c, nil
+}
+
+func lookupKDF(id uint8) (func(secret, salt, info []byte) io.Reader, error) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	kdf, ok := hkdfs[id]
+	if !ok {
+		return nil, ErrUnknownAlgorithm
+	}
+	return kdf, nil
+}
+
+//initAlgorithms resolves the algorithm ids of the state to their implementations
+func initAlgorithms(s *State) error {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	c, ok := dhCurves[s.CurveParam]
+	if !ok {
+		return ErrUnknownAlgorithm
+	}
+	sc, ok := streamCiphers[s.StreamCipher]
+	if !ok {
+		return ErrUnknownAlgorithm
+	}
+	kdf, ok := hkdfs[s.HKDF]
+	if !ok {
+		return ErrUnknownAlgorithm
+	}
+	mac, ok := hmacs[s.HMAC]
+	if !ok {
+		return ErrUnknownAlgorithm
+	}
+	s.dh = c
+	s.streamCipher = sc
+	s.hkdf = kdf
+	s.hmac = mac
+	s.suiteID = stateSuite(s).ID
+	return nil
+}
+
+func algorithmName(names *algorithmNames, id uint8) string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return names.byID[id]
+}
+
+func algorithmID(names *algorithmNames, name string) (uint8, error) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	id, ok := names.byName[name]
+	if !ok {
+		return 0, ErrUnknownAlgorithm
+	}
+	return id, nil
+}
@@ -0,0 +1,92 @@
+package axolotl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+//digestSize is the length of the digests the replay window keeps
+const digestSize = 16
+
+//seenMessage identifies a decrypted message by digests of its encrypted header
+//and body. A replay carries the very same header, so it is recognized without
+//keeping any key of its chain.
+type seenMessage struct {
+	n      uint32
+	header [digestSize]byte
+	body   [digestSize]byte
+}
+
+//seenChain records the decrypted messages of one receiving chain
+type seenChain struct {
+	ratchetKey []byte
+	messages   []seenMessage
+}
+
+//digestMessage returns the digests of the header, covering ad and the envelope,
+//and of the body of m
+func digestMessage(m *message, ad []byte) seenMessage {
+	var seen seenMessage
+	h := sha256.New()
+	hdrAD := headerAD(ad, m)
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(hdrAD))))
+	h.Write(hdrAD)
+	h.Write(m.headerNonce)
+	h.Write(m.headerData)
+	copy(seen.header[:], h.Sum(nil))
+	h.Reset()
+	h.Write(m.messageNonce)
+	h.Write(m.messageData)
+	copy(seen.body[:], h.Sum(nil))
+	return seen
+}
+
+//checkReplay returns ErrDuplicateMessage if the window holds the message and
+//ErrBodyAuthentication if it holds its header with another body
+func checkReplay(s *State, seen seenMessage) error {
+	for i := len(s.seen) - 1; i >= 0; i-- {
+		c := &s.seen[i]
+		for _, m := range c.messages {
+			if m.header != seen.header {
+				continue
+			}
+			if m.body != seen.body {
+				return decryptFailure(ErrBodyAuthentication, m.n, c.ratchetKey)
+			}
+			return decryptFailure(ErrDuplicateMessage, m.n, c.ratchetKey)
+		}
+	}
+	return nil
+}
+
+//recordSeen adds the decrypted message n of the chain with ratchet key rk to the
+//replay window and drops the oldest entries beyond the limits
+func recordSeen(s *State, rk []byte, n uint32, seen seenMessage) {
+	if s.Limits.ReplayWindow <= 0 {
+		return
+	}
+	seen.n = n
+	var c *seenChain
+	for i := len(s.seen) - 1; i >= 0 && c == nil; i-- {
+		if bytes.Equal(s.seen[i].ratchetKey, rk) {
+			c = &s.seen[i]
+		}
+	}
+	if c == nil {
+		s.seen = append(s.seen, seenChain{ratchetKey: append([]byte{}, rk...)})
+		c = &s.seen[len(s.seen)-1]
+	}
+	c.messages = append(c.messages, seen)
+
+	total := 0
+	for _, c := range s.seen {
+		total += len(c.messages)
+	}
+	for ; total > s.Limits.ReplayWindow; total-- {
+		s.seen[0].messages = s.seen[0].messages[1:]
+		if len(s.seen[0].messages) == 0 {
+			s.seen = s.seen[1:]
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package axolotl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+)
+
+//Key derivations of sealed states
+const (
+	sealedKDFKey      = 0
+	sealedKDFArgon2id = 1
+)
+
+//sealedMagic starts every sealed state, followed by the format version
+var sealedMagic = [3]byte{'A', 'X', 'S'}
+
+const sealedVersion1 = 1
+
+//sealedHeaderSize is the size of magic, version, kdf, salt, argon2id parameters and nonce
+const sealedHeaderSize = 3 + 1 + 1 + 16 + 4 + 4 + 1 + chacha20poly1305.NonceSizeX
+
+//Argon2id parameters for new passphrase protected states, see RFC 9106 section 4
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
+
+//Upper bounds for the parameters accepted when loading, so a forged header cannot
+//make loading exhaust memory or time
+const (
+	maxArgon2Time    = 16
+	maxArgon2Memory  = 256 * 1024
+	maxArgon2Threads = 16
+)
+
+//sealedHeader is authenticated as associated data of the sealed state so none
+//of its fields can be altered without detection
+type sealedHeader [sealedHeaderSize]byte
+
+func (h *sealedHeader) kdf() byte {
+	return h[4]
+}
+
+func (h *sealedHeader) salt() []byte {
+	return h[5:21]
+}
+
+func (h *sealedHeader) argon2Params() (uint32, uint32, uint8) {
+	return binary.BigEndian.Uint32(h[21:25]), binary.BigEndian.Uint32(h[25:29]), h[29]
+}
+
+func (h *sealedHeader) nonce() []byte {
+	return h[30:]
+}
+
+func newSealedHeader(kdf byte, randomData io.Reader) (*sealedHeader, error) {
+	h := &sealedHeader{}
+	copy(h[0:3], sealedMagic[:])
+	h[3] = sealedVersion1
+	h[4] = kdf
+	if kdf == sealedKDFArgon2id {
+		_, err := io.ReadFull(randomData, h.salt())
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(h[21:25], argon2Time)
+		binary.BigEndian.PutUint32(h[25:29], argon2Memory)
+		h[29] = argon2Threads
+	}
+	_, err := io.ReadFull(randomData, h.nonce())
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func readSealedHeader(rd io.Reader, kdf byte) (*sealedHeader, error) {
+	h := &sealedHeader{}
+	_, err := io.ReadFull(rd, h[:])
+	if err != nil {
+		return nil, err
+	}
+	if h[0] != sealedMagic[0] || h[1] != sealedMagic[1] || h[2] != sealedMagic[2] {
+		return nil, ErrInvalidState
+	}
+	if h[3] != sealedVersion1 {
+		return nil, ErrUnsupportedVersion
+	}
+	if h.kdf() != kdf {
+		return nil, ErrInvalidState
+	}
+	if kdf == sealedKDFArgon2id {
+		t, m, p := h.argon2Params()
+		if t == 0 || t > maxArgon2Time || m == 0 || m > maxArgon2Memory || p == 0 || p > maxArgon2Threads {
+			return nil, ErrInvalidState
+		}
+	}
+	return h, nil
+}
+
+func passphraseKey(h *sealedHeader, passphrase []byte) key {
+	t, m, p := h.argon2Params()
+	return argon2.IDKey(passphrase, h.salt(), t, m, p, chacha20poly1305.KeySize)
+}
+
+func sealState(s *State, w io.Writer, kek []byte, h *sealedHeader) error {
+	aead, err := chacha20poly1305.NewX(kek)
+	if err != nil {
+		return ErrInvalidKeyLength
+	}
+	var buf bytes.Buffer
+	err = writeState(s, &buf)
+	if err != nil {
+		return err
+	}
+	pt := buf.Bytes()
+	defer zeroKey(pt)
+	b := aead.Seal(append([]byte{}, h[:]...), h.nonce(), pt, h[:])
+	_, err = w.Write(b)
+	return err
+}
+
+func openState(rd io.Reader, kek []byte, h *sealedHeader) (*State, error) {
+	aead, err := chacha20poly1305.NewX(kek)
+	if err != nil {
+		return nil, ErrInvalidKeyLength
+	}
+	ct, err := io.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := aead.Open(nil, h.nonce(), ct, h[:])
+	if err != nil {
+		return nil, ErrInvalidState
+	}
+	defer zeroKey(pt)
+	return readState(bytes.NewReader(pt))
+}
+
+func axolotlSaveEncrypted(s *State, w io.Writer, kek []byte, randomData io.Reader) error {
+	if len(kek) != chacha20poly1305.KeySize {
+		return ErrInvalidKeyLength
+	}
+	h, err := newSealedHeader(sealedKDFKey, randomData)
+	if err != nil {
+		return err
+	}
+	return sealState(s, w, kek, h)
+}
+
+func axolotlLoadEncrypted(rd io.Reader, kek []byte) (*State, error) {
+	if len(kek) != chacha20poly1305.KeySize {
+		return nil, ErrInvalidKeyLength
+	}
+	h, err := readSealedHeader(rd, sealedKDFKey)
+	if err != nil {
+		return nil, err
+	}
+	return openState(rd, kek, h)
+}
+
+func axolotlSaveEncryptedPassphrase(s *State, w io.Writer, passphrase []byte, randomData io.Reader) error {
+	h, err := newSealedHeader(sealedKDFArgon2id, randomData)
+	if err != nil {
+		return err
+	}
+	kek := passphraseKey(h, passphrase)
+	defer zeroKey(kek)
+	return sealState(s, w, kek, h)
+}
+
+func axolotlLoadEncryptedPassphrase(rd io.Reader, passphrase []byte) (*State, error) {
+	h, err := readSealedHeader(rd, sealedKDFArgon2id)
+	if err != nil {
+		return nil, err
+	}
+	kek := passphraseKey(h, passphrase)
+	defer zeroKey(kek)
+	return openState(rd, kek, h)
+}
@@ -0,0 +1,103 @@
+package axolotl
+
+import (
+	"io"
+	"sync"
+)
+
+//Session makes a State safe for use by multiple goroutines
+//Encryptions are serialized with each other and decryptions are serialized with
+//each other, but the sending and the receiving chain progress independently.
+//Only DH ratchet steps, which change the root key, exclude each other.
+type Session struct {
+	sendMu sync.Mutex
+	recvMu sync.Mutex
+	rootMu sync.Mutex
+	state  *State
+}
+
+//NewSession wraps the state, it must not be used directly afterwards
+func NewSession(s *State) *Session {
+	session := &Session{state: s}
+	s.rootLock = &session.rootMu
+	return session
+}
+
+func lockRoot(s *State) {
+	if s.rootLock != nil {
+		s.rootLock.Lock()
+	}
+}
+
+func unlockRoot(s *State) {
+	if s.rootLock != nil {
+		s.rootLock.Unlock()
+	}
+}
+
+//lockAll stops all operations on the session until the returned function is called
+func (session *Session) lockAll() func() {
+	session.sendMu.Lock()
+	session.recvMu.Lock()
+	session.rootMu.Lock()
+	return func() {
+		session.rootMu.Unlock()
+		session.recvMu.Unlock()
+		session.sendMu.Unlock()
+	}
+}
+
+//EncryptMessage encrypts the message, see State.EncryptMessage
+func (session *Session) EncryptMessage(message []byte) ([]byte, error) {
+	return session.EncryptMessageAD(message, nil)
+}
+
+//EncryptMessageAD encrypts the message and authenticates ad, see State.EncryptMessageAD
+func (session *Session) EncryptMessageAD(message, ad []byte) ([]byte, error) {
+	session.sendMu.Lock()
+	defer session.sendMu.Unlock()
+	return axolotlEncryptMessage(session.state, message, ad, session.state.randomSource())
+}
+
+//DecryptMessage decrypts the message read from rd, see State.DecryptMessage
+func (session *Session) DecryptMessage(rd io.Reader) ([]byte, error) {
+	session.recvMu.Lock()
+	defer session.recvMu.Unlock()
+	return axolotlDecryptMessage(session.state, rd, nil)
+}
+
+//DecryptMessageBuffer decrypts the message, see State.DecryptMessageBuffer
+func (session *Session) DecryptMessageBuffer(b []byte) ([]byte, error) {
+	return session.DecryptMessageAD(b, nil)
+}
+
+//DecryptMessageAD decrypts the message and verifies ad, see State.DecryptMessageAD
+func (session *Session) DecryptMessageAD(b, ad []byte) ([]byte, error) {
+	session.recvMu.Lock()
+	defer session.recvMu.Unlock()
+	return axolotlDecryptMessageBuffer(session.state, b, ad)
+}
+
+//EncryptStream encrypts the stream, see State.EncryptStream
+//Other encryptions only wait for the ratchet message starting the stream, not for its chunks.
+func (session *Session) EncryptStream(w io.Writer, r io.Reader) error {
+	return axolotlEncryptStream(session.state, w, r, session.state.randomSource(), &session.sendMu)
+}
+
+//DecryptStream decrypts the stream, see State.DecryptStream
+//Other decryptions only wait for the ratchet message starting the stream, not for its chunks.
+func (session *Session) DecryptStream(w io.Writer, r io.Reader) error {
+	return axolotlDecryptStream(session.state, w, r, &session.recvMu)
+}
+
+//MarshalBinary returns a consistent snapshot of the state, see State.MarshalBinary
+func (session *Session) MarshalBinary() ([]byte, error) {
+	defer session.lockAll()()
+	return axolotlMarshalBinary(session.state)
+}
+
+//SaveTo saves a consistent snapshot of the state, see State.SaveTo
+func (session *Session) SaveTo(fileName string) error {
+	defer session.lockAll()()
+	return axolotlSaveTo(session.state, fileName)
+}
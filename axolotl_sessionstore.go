@@ -0,0 +1,292 @@
+package axolotl
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Address identifies the session with one device of a peer
+type Address struct {
+	Name     string
+	DeviceID uint32
+}
+
+//String returns the address as name.device
+func (a Address) String() string {
+	return a.Name + "." + strconv.FormatUint(uint64(a.DeviceID), 10)
+}
+
+//SessionStore stores the states of sessions by address
+//Load returns ErrSessionNotFound if no state is stored for the address.
+type SessionStore interface {
+	Load(addr Address) (*State, error)
+	Store(addr Address, s *State) error
+	Delete(addr Address) error
+	List() ([]Address, error)
+}
+
+func sortAddresses(addrs []Address) {
+	sort.Slice(addrs, func(i, j int) bool {
+		if addrs[i].Name != addrs[j].Name {
+			return addrs[i].Name < addrs[j].Name
+		}
+		return addrs[i].DeviceID < addrs[j].DeviceID
+	})
+}
+
+//MemorySessionStore keeps serialized states in memory
+//Every Load returns a new copy, so a state is only changed by storing it again.
+type MemorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[Address][]byte
+}
+
+//NewMemorySessionStore returns an empty in-memory store
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[Address][]byte)}
+}
+
+//Load returns a copy of the state stored for addr
+func (m *MemorySessionStore) Load(addr Address) (*State, error) {
+	m.mu.RLock()
+	b, ok := m.sessions[addr]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	s := &State{}
+	err := s.UnmarshalBinary(b)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//Store stores a copy of the state for addr
+func (m *MemorySessionStore) Store(addr Address, s *State) error {
+	b, err := s.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	zeroKey(m.sessions[addr])
+	m.sessions[addr] = b
+	return nil
+}
+
+//Delete removes the state stored for addr
+func (m *MemorySessionStore) Delete(addr Address) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	zeroKey(m.sessions[addr])
+	delete(m.sessions, addr)
+	return nil
+}
+
+//List returns the addresses of all stored states
+func (m *MemorySessionStore) List() ([]Address, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	addrs := make([]Address, 0, len(m.sessions))
+	for addr := range m.sessions {
+		addrs = append(addrs, addr)
+	}
+	sortAddresses(addrs)
+	return addrs, nil
+}
+
+//DirectorySessionStore keeps every state in its own file below a directory
+//The files are written by SaveTo and named after the hex encoded name and the
+//device id of the address. The keys are stored in the clear.
+type DirectorySessionStore struct {
+	dir string
+}
+
+const sessionFileSuffix = ".state"
+
+//NewDirectorySessionStore returns a store keeping its states in dir, dir gets created if needed
+func NewDirectorySessionStore(dir string) (*DirectorySessionStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &DirectorySessionStore{dir: dir}, nil
+}
+
+func (d *DirectorySessionStore) fileName(addr Address) string {
+	return filepath.Join(d.dir, hex.EncodeToString([]byte(addr.Name))+"."+strconv.FormatUint(uint64(addr.DeviceID), 10)+sessionFileSuffix)
+}
+
+//Load reads the state stored for addr
+func (d *DirectorySessionStore) Load(addr Address) (*State, error) {
+	s, err := axolotlFromFile(d.fileName(addr))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrSessionNotFound
+	}
+	return s, err
+}
+
+//Store replaces the state stored for addr atomically
+func (d *DirectorySessionStore) Store(addr Address, s *State) error {
+	return axolotlSaveTo(s, d.fileName(addr))
+}
+
+//Delete removes the state stored for addr
+func (d *DirectorySessionStore) Delete(addr Address) error {
+	err := os.Remove(d.fileName(addr))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+//List returns the addresses of all stored states
+func (d *DirectorySessionStore) List() ([]Address, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []Address
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), sessionFileSuffix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		i := strings.LastIndexByte(name, '.')
+		if i < 0 {
+			continue
+		}
+		n, err := hex.DecodeString(name[:i])
+		if err != nil {
+			continue
+		}
+		device, err := strconv.ParseUint(name[i+1:], 10, 32)
+		if err != nil {
+			continue
+		}
+		addrs = append(addrs, Address{Name: string(n), DeviceID: uint32(device)})
+	}
+	sortAddresses(addrs)
+	return addrs, nil
+}
+
+//SessionManager loads the state of a session from a SessionStore, encrypts or
+//decrypts with it and stores the changed state in one call
+//Calls for the same address are serialized.
+type SessionManager struct {
+	store   SessionStore
+	prepare func(addr Address, s *State) error
+	mu      sync.Mutex
+	locks   map[Address]*addressLock
+}
+
+//addressLock serializes the calls for an address, it is dropped from the map
+//once no call holds or waits for it
+type addressLock struct {
+	sync.Mutex
+	users int
+}
+
+//NewSessionManager returns a manager keeping its sessions in store
+//The random source, the clock and a skipped key store other than the memory
+//store are not saved with a state. prepare is called with every loaded state
+//to set them again, it may be nil.
+func NewSessionManager(store SessionStore, prepare func(addr Address, s *State) error) *SessionManager {
+	return &SessionManager{store: store, prepare: prepare, locks: make(map[Address]*addressLock)}
+}
+
+//lock locks addr until the returned function is called
+func (m *SessionManager) lock(addr Address) func() {
+	m.mu.Lock()
+	l, ok := m.locks[addr]
+	if !ok {
+		l = &addressLock{}
+		m.locks[addr] = l
+	}
+	l.users++
+	m.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(m.locks, addr)
+		}
+		m.mu.Unlock()
+	}
+}
+
+//Store stores the state of a new session, replacing any session with addr
+func (m *SessionManager) Store(addr Address, s *State) error {
+	defer m.lock(addr)()
+	return m.store.Store(addr, s)
+}
+
+//Delete removes the session with addr
+func (m *SessionManager) Delete(addr Address) error {
+	defer m.lock(addr)()
+	return m.store.Delete(addr)
+}
+
+//List returns the addresses of all sessions
+func (m *SessionManager) List() ([]Address, error) {
+	return m.store.List()
+}
+
+//update runs fn with the state of addr and stores the state if fn succeeds
+func (m *SessionManager) update(addr Address, fn func(s *State) ([]byte, error)) ([]byte, error) {
+	defer m.lock(addr)()
+	s, err := m.store.Load(addr)
+	if err != nil {
+		return nil, err
+	}
+	if m.prepare != nil {
+		err = m.prepare(addr, s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b, err := fn(s)
+	if err != nil {
+		return nil, err
+	}
+	err = m.store.Store(addr, s)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+//Encrypt encrypts the message for the session with addr
+//The ciphertext is only returned after the advanced state has been stored.
+func (m *SessionManager) Encrypt(addr Address, message []byte) ([]byte, error) {
+	return m.EncryptAD(addr, message, nil)
+}
+
+//EncryptAD encrypts the message and authenticates ad for the session with addr, see State.EncryptMessageAD
+func (m *SessionManager) EncryptAD(addr Address, message, ad []byte) ([]byte, error) {
+	return m.update(addr, func(s *State) ([]byte, error) {
+		return s.EncryptMessageAD(message, ad)
+	})
+}
+
+//Decrypt decrypts the message of the session with addr
+//The plaintext is only returned after the advanced state has been stored.
+func (m *SessionManager) Decrypt(addr Address, message []byte) ([]byte, error) {
+	return m.DecryptAD(addr, message, nil)
+}
+
+//DecryptAD decrypts the message and verifies ad for the session with addr, see State.DecryptMessageAD
+func (m *SessionManager) DecryptAD(addr Address, message, ad []byte) ([]byte, error) {
+	return m.update(addr, func(s *State) ([]byte, error) {
+		return s.DecryptMessageAD(message, ad)
+	})
+}
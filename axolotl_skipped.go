@@ -0,0 +1,394 @@
+package axolotl
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//SkippedKey holds the keys of a message which was skipped by the receiving chain
+type SkippedKey struct {
+	HeaderKey   []byte
+	MessageKey  []byte
+	N           uint32
+	RatchetStep uint32
+	Stored      time.Time
+}
+
+//SkippedKeyStore stores the keys of skipped messages until the messages arrive
+//Keys are identified by the header key of their chain and their message number.
+type SkippedKeyStore interface {
+	//Put stores the keys, a key replaces one with the same header key and message number
+	Put(keys ...SkippedKey) error
+	//HeaderKeys returns the distinct header keys of all stored keys
+	HeaderKeys() ([][]byte, error)
+	//Lookup returns the message key stored for the header key and message number
+	Lookup(headerKey []byte, n uint32) ([]byte, bool, error)
+	//Delete removes the key stored for the header key and message number
+	Delete(headerKey []byte, n uint32) error
+	//Evict removes all keys for which expired returns true and afterwards the
+	//oldest keys until at most maxKeys are left, maxKeys 0 means no limit
+	Evict(maxKeys int, expired func(k SkippedKey) bool) error
+	//Len returns the number of stored keys
+	Len() (int, error)
+}
+
+//MemorySkippedKeyStore keeps skipped keys in memory, it is the default store of a State
+type MemorySkippedKeyStore struct {
+	mu   sync.Mutex
+	keys *list.List
+}
+
+//NewMemorySkippedKeyStore returns an empty in-memory store
+func NewMemorySkippedKeyStore() *MemorySkippedKeyStore {
+	return &MemorySkippedKeyStore{keys: list.New()}
+}
+
+func (m *MemorySkippedKeyStore) find(headerKey []byte, n uint32) *list.Element {
+	for e := m.keys.Front(); e != nil; e = e.Next() {
+		k := e.Value.(SkippedKey)
+		if k.N == n && bytes.Equal(k.HeaderKey, headerKey) {
+			return e
+		}
+	}
+	return nil
+}
+
+//Put stores the keys
+func (m *MemorySkippedKeyStore) Put(keys ...SkippedKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range keys {
+		if e := m.find(k.HeaderKey, k.N); e != nil {
+			e.Value = k
+			continue
+		}
+		m.keys.PushBack(k)
+	}
+	return nil
+}
+
+//HeaderKeys returns the distinct header keys of all stored keys
+func (m *MemorySkippedKeyStore) HeaderKeys() ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var hks [][]byte
+	for e := m.keys.Front(); e != nil; e = e.Next() {
+		hk := e.Value.(SkippedKey).HeaderKey
+		found := false
+		for _, h := range hks {
+			if bytes.Equal(h, hk) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			hks = append(hks, hk)
+		}
+	}
+	return hks, nil
+}
+
+//Lookup returns the message key stored for the header key and message number
+func (m *MemorySkippedKeyStore) Lookup(headerKey []byte, n uint32) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.find(headerKey, n)
+	if e == nil {
+		return nil, false, nil
+	}
+	return e.Value.(SkippedKey).MessageKey, true, nil
+}
+
+//Delete removes the key stored for the header key and message number
+func (m *MemorySkippedKeyStore) Delete(headerKey []byte, n uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e := m.find(headerKey, n); e != nil {
+		m.keys.Remove(e)
+	}
+	return nil
+}
+
+//Evict removes expired keys and the oldest keys above maxKeys
+func (m *MemorySkippedKeyStore) Evict(maxKeys int, expired func(k SkippedKey) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var next *list.Element
+	for e := m.keys.Front(); e != nil; e = next {
+		next = e.Next()
+		if expired(e.Value.(SkippedKey)) {
+			m.keys.Remove(e)
+		}
+	}
+	for maxKeys > 0 && m.keys.Len() > maxKeys {
+		m.keys.Remove(m.keys.Front())
+	}
+	return nil
+}
+
+//Len returns the number of stored keys
+func (m *MemorySkippedKeyStore) Len() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.keys.Len(), nil
+}
+
+//all returns the stored keys in the order they were stored
+func (m *MemorySkippedKeyStore) all() []SkippedKey {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]SkippedKey, 0, m.keys.Len())
+	for e := m.keys.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(SkippedKey))
+	}
+	return keys
+}
+
+//FileSkippedKeyStore keeps skipped keys in a directory, one file per key
+//The file name holds the hex encoded header key, the message number, the
+//ratchet step and the time the key was stored, so listing the directory is all
+//HeaderKeys, Evict and Len need. Files are written atomically and no directory
+//is ever removed, so several processes can share the directory. The keys are
+//stored in the clear.
+type FileSkippedKeyStore struct {
+	dir string
+}
+
+//NewFileSkippedKeyStore returns a store keeping its keys in dir, dir gets created if needed
+func NewFileSkippedKeyStore(dir string) (*FileSkippedKeyStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSkippedKeyStore{dir: dir}, nil
+}
+
+//keyID returns the part of the file name identifying the key of message n of the chain
+func keyID(headerKey []byte, n uint32) string {
+	return hex.EncodeToString(headerKey) + "." + strconv.FormatUint(uint64(n), 10)
+}
+
+//keyName returns the file name of k, its id followed by the ratchet step and
+//the time it was stored
+func keyName(k SkippedKey) string {
+	return keyID(k.HeaderKey, k.N) + "." + strconv.FormatUint(uint64(k.RatchetStep), 10) +
+		"." + strconv.FormatInt(k.Stored.UnixNano(), 10)
+}
+
+//parseKeyName returns the key named name without its message key
+func parseKeyName(name string) (SkippedKey, bool) {
+	parts := strings.Split(name, ".")
+	if len(parts) != 4 || parts[0] == "" {
+		return SkippedKey{}, false
+	}
+	hk, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return SkippedKey{}, false
+	}
+	n, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return SkippedKey{}, false
+	}
+	step, err := strconv.ParseUint(parts[2], 10, 32)
+	if err != nil {
+		return SkippedKey{}, false
+	}
+	stored, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return SkippedKey{}, false
+	}
+	return SkippedKey{HeaderKey: hk, N: uint32(n), RatchetStep: uint32(step), Stored: time.Unix(0, stored)}, true
+}
+
+//walk calls fn for every stored key without its message key, the files are not read
+func (f *FileSkippedKeyStore) walk(fn func(k SkippedKey, p string) error) error {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		k, ok := parseKeyName(e.Name())
+		if !ok {
+			continue
+		}
+		err = fn(k, filepath.Join(f.dir, e.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//find returns the path of the file of message n of the chain, "" if there is none
+func (f *FileSkippedKeyStore) find(headerKey []byte, n uint32) (string, error) {
+	var found string
+	err := f.walk(func(k SkippedKey, p string) error {
+		if k.N == n && bytes.Equal(k.HeaderKey, headerKey) {
+			found = p
+		}
+		return nil
+	})
+	return found, err
+}
+
+//Put stores the keys
+//Every key gets a file of its own, the directory is listed and synced once for all of them.
+func (f *FileSkippedKeyStore) Put(keys ...SkippedKey) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	old := make(map[string]string)
+	err := f.walk(func(k SkippedKey, p string) error {
+		old[keyID(k.HeaderKey, k.N)] = p
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = writeFileRenamed(filepath.Join(f.dir, keyName(k)), k.MessageKey)
+		if err != nil {
+			return err
+		}
+	}
+	err = syncDir(f.dir)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		p, ok := old[keyID(k.HeaderKey, k.N)]
+		if !ok || p == filepath.Join(f.dir, keyName(k)) {
+			continue
+		}
+		err = f.remove(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//HeaderKeys returns the distinct header keys of all stored keys
+func (f *FileSkippedKeyStore) HeaderKeys() ([][]byte, error) {
+	seen := make(map[string]bool)
+	var hks [][]byte
+	err := f.walk(func(k SkippedKey, p string) error {
+		if !seen[string(k.HeaderKey)] {
+			seen[string(k.HeaderKey)] = true
+			hks = append(hks, k.HeaderKey)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hks, nil
+}
+
+//Lookup returns the message key stored for the header key and message number
+func (f *FileSkippedKeyStore) Lookup(headerKey []byte, n uint32) ([]byte, bool, error) {
+	p, err := f.find(headerKey, n)
+	if err != nil || p == "" {
+		return nil, false, err
+	}
+	mk, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return mk, true, nil
+}
+
+func (f *FileSkippedKeyStore) remove(p string) error {
+	err := os.Remove(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+//Delete removes the key stored for the header key and message number
+func (f *FileSkippedKeyStore) Delete(headerKey []byte, n uint32) error {
+	p, err := f.find(headerKey, n)
+	if err != nil || p == "" {
+		return err
+	}
+	return f.remove(p)
+}
+
+//Evict removes expired keys and the oldest keys above maxKeys
+func (f *FileSkippedKeyStore) Evict(maxKeys int, expired func(k SkippedKey) bool) error {
+	type entry struct {
+		stored time.Time
+		path   string
+	}
+	var kept []entry
+	err := f.walk(func(k SkippedKey, p string) error {
+		if expired(k) {
+			return f.remove(p)
+		}
+		kept = append(kept, entry{k.Stored, p})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if maxKeys <= 0 || len(kept) <= maxKeys {
+		return nil
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].stored.Before(kept[j].stored) })
+	for _, e := range kept[:len(kept)-maxKeys] {
+		err = f.remove(e.path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Len returns the number of stored keys
+func (f *FileSkippedKeyStore) Len() (int, error) {
+	n := 0
+	err := f.walk(func(k SkippedKey, p string) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+func axolotlSetSkippedKeyStore(s *State, store SkippedKeyStore) error {
+	if store == nil {
+		return ErrInvalidStore
+	}
+	if m, ok := s.skippedKeys.(*MemorySkippedKeyStore); ok {
+		err := store.Put(m.all()...)
+		if err != nil {
+			return err
+		}
+	} else if s.skippedKeys != nil && s.skippedKeys != store {
+		//the interface cannot enumerate the keys of other stores
+		n, err := s.skippedKeys.Len()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrSkippedKeysNotMoved
+		}
+	}
+	s.skippedKeys = store
+	return nil
+}
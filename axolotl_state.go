@@ -0,0 +1,458 @@
+package axolotl
+
+import (
+	"encoding/binary"
+	"github.com/arcpop/ecdh"
+	"io"
+	"math"
+	"time"
+)
+
+//stateMagic starts every versioned state. The legacy layout starts with the
+//four algorithm ids, which never spell out the magic for the built-in algorithms.
+var stateMagic = [4]byte{'A', 'X', 'S', 'T'}
+
+//State format versions
+const (
+	stateVersionLegacy = 0
+	stateVersion1      = 1
+)
+
+//A versioned state is the magic and the version followed by records of a one byte
+//tag, a four byte length and the value. The records end with stateTagEnd.
+//Readers skip records with unknown tags, so new fields can be added without a new
+//version as long as older readers can safely ignore them.
+const (
+	stateTagEnd = iota
+	stateTagAlgorithms
+	stateTagFlags
+	stateTagCounters
+	stateTagRootKey
+	stateTagHeaderNonceSource
+	stateTagHdrKeyS
+	stateTagHdrKeyR
+	stateTagNextHdrKeyS
+	stateTagNextHdrKeyR
+	stateTagChainKeyS
+	stateTagChainKeyR
+	stateTagDHPrivateKey
+	stateTagDHPublicKey
+	stateTagPeerDHPublicKey
+	stateTagSkippedKey
+	stateTagPQ
+	stateTagPQDecapKey
+	stateTagPQPeerEncapKey
+	stateTagPQHeader
+	stateTagLimits
+	stateTagPadding
+	stateTagSeenChain
+)
+
+//maxStateRecord bounds the length of a single record
+const maxStateRecord = 1 << 20
+
+func appendRecord(b []byte, tag byte, v []byte) []byte {
+	b = append(b, tag)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(v)))
+	return append(b, v...)
+}
+
+func appendSkippedKey(b []byte, k SkippedKey) []byte {
+	b = appendField(b, k.HeaderKey)
+	b = appendField(b, k.MessageKey)
+	b = binary.BigEndian.AppendUint32(b, k.N)
+	b = binary.BigEndian.AppendUint32(b, k.RatchetStep)
+	return binary.BigEndian.AppendUint64(b, uint64(k.Stored.UnixNano()))
+}
+
+func parseSkippedKey(v []byte) (SkippedKey, error) {
+	var k SkippedKey
+	var err error
+	k.HeaderKey, v, err = readField(v)
+	if err != nil {
+		return k, ErrInvalidState
+	}
+	k.MessageKey, v, err = readField(v)
+	if err != nil {
+		return k, ErrInvalidState
+	}
+	if len(v) != 16 {
+		return k, ErrInvalidState
+	}
+	k.N = binary.BigEndian.Uint32(v[0:4])
+	k.RatchetStep = binary.BigEndian.Uint32(v[4:8])
+	k.Stored = time.Unix(0, int64(binary.BigEndian.Uint64(v[8:16])))
+	return k, nil
+}
+
+//seenMessageSize is the encoded size of a seenMessage
+const seenMessageSize = 4 + 2*digestSize
+
+func appendSeenChain(b []byte, c seenChain) []byte {
+	b = appendField(b, c.ratchetKey)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(c.messages)))
+	for _, m := range c.messages {
+		b = binary.BigEndian.AppendUint32(b, m.n)
+		b = append(b, m.header[:]...)
+		b = append(b, m.body[:]...)
+	}
+	return b
+}
+
+func parseSeenChain(v []byte) (seenChain, error) {
+	var c seenChain
+	var err error
+	c.ratchetKey, v, err = readField(v)
+	if err != nil {
+		return c, ErrInvalidState
+	}
+	if len(v) < 4 || uint64(len(v)-4) != seenMessageSize*uint64(binary.BigEndian.Uint32(v[0:4])) {
+		return c, ErrInvalidState
+	}
+	for v = v[4:]; len(v) > 0; v = v[seenMessageSize:] {
+		m := seenMessage{n: binary.BigEndian.Uint32(v[0:4])}
+		copy(m.header[:], v[4:4+digestSize])
+		copy(m.body[:], v[4+digestSize:seenMessageSize])
+		c.messages = append(c.messages, m)
+	}
+	return c, nil
+}
+
+//encodeState returns the state in the current versioned format
+func encodeState(s *State) []byte {
+	b := append([]byte{}, stateMagic[:]...)
+	b = append(b, stateVersion1)
+
+	b = appendRecord(b, stateTagAlgorithms, []byte{s.CurveParam, s.StreamCipher, s.HKDF, s.HMAC})
+	var flags [2]byte
+	if s.SenderSide {
+		flags[0] = 1
+	}
+	if s.ratchetFlag {
+		flags[1] = 1
+	}
+	b = appendRecord(b, stateTagFlags, flags[:])
+	var counters [16]byte
+	binary.BigEndian.PutUint32(counters[0:4], s.msgNumS)
+	binary.BigEndian.PutUint32(counters[4:8], s.msgNumR)
+	binary.BigEndian.PutUint32(counters[8:12], s.prevMsgNumS)
+	binary.BigEndian.PutUint32(counters[12:16], s.ratchetSteps)
+	b = appendRecord(b, stateTagCounters, counters[:])
+
+	b = appendRecord(b, stateTagRootKey, s.rootKey)
+	b = appendRecord(b, stateTagHeaderNonceSource, s.headerNonceSource)
+	b = appendRecord(b, stateTagHdrKeyS, s.hdrKeyS)
+	b = appendRecord(b, stateTagHdrKeyR, s.hdrKeyR)
+	b = appendRecord(b, stateTagNextHdrKeyS, s.nextHdrKeyS)
+	b = appendRecord(b, stateTagNextHdrKeyR, s.nextHdrKeyR)
+	b = appendRecord(b, stateTagChainKeyS, s.chainKeyS)
+	b = appendRecord(b, stateTagChainKeyR, s.chainKeyR)
+	if s.dhParams != nil {
+		b = appendRecord(b, stateTagDHPrivateKey, s.dhParams.PrivateKey)
+		b = appendRecord(b, stateTagDHPublicKey, s.dhParams.PublicKey)
+	}
+	b = appendRecord(b, stateTagPeerDHPublicKey, s.dhPublicKey)
+
+	//Only keys of the in-memory store are saved with the state, other stores
+	//keep their keys themselves and are attached again by SetSkippedKeyStore
+	if m, ok := s.skippedKeys.(*MemorySkippedKeyStore); ok {
+		for _, k := range m.all() {
+			b = appendRecord(b, stateTagSkippedKey, appendSkippedKey(nil, k))
+		}
+	}
+
+	for _, c := range s.seen {
+		b = appendRecord(b, stateTagSeenChain, appendSeenChain(nil, c))
+	}
+
+	if s.pqRatchet {
+		pq := make([]byte, 10)
+		pq[0] = 1
+		pq[1] = s.pqKEM
+		binary.BigEndian.PutUint32(pq[2:6], s.pqInterval)
+		binary.BigEndian.PutUint32(pq[6:10], s.pqSteps)
+		b = appendRecord(b, stateTagPQ, pq)
+		b = appendRecord(b, stateTagPQDecapKey, s.pqDecapKey)
+		b = appendRecord(b, stateTagPQPeerEncapKey, s.pqPeerEncapKey)
+		b = appendRecord(b, stateTagPQHeader, s.pqHeader)
+	}
+
+	var limits [32]byte
+	binary.BigEndian.PutUint32(limits[0:4], s.Limits.MaxSkip)
+	binary.BigEndian.PutUint32(limits[4:8], uint32(s.Limits.MaxSkippedKeys))
+	binary.BigEndian.PutUint64(limits[8:16], uint64(s.Limits.MaxSkippedAge))
+	binary.BigEndian.PutUint32(limits[16:20], s.Limits.MaxSkippedRatchetSteps)
+	binary.BigEndian.PutUint32(limits[20:24], s.Limits.MaxHeaderSize)
+	binary.BigEndian.PutUint32(limits[24:28], s.Limits.MaxMessageSize)
+	binary.BigEndian.PutUint32(limits[28:32], uint32(s.Limits.ReplayWindow))
+	b = appendRecord(b, stateTagLimits, limits[:])
+	if s.padding > 0 {
+		b = appendRecord(b, stateTagPadding, binary.BigEndian.AppendUint32(nil, s.padding))
+	}
+
+	return appendRecord(b, stateTagEnd, nil)
+}
+
+//writeState writes the state to f in the current versioned format
+func writeState(s *State, f io.Writer) error {
+	err := checkStateLimits(s.Limits)
+	if err != nil {
+		return err
+	}
+	b := encodeState(s)
+	defer zeroKey(b)
+	//Write returns an error for short writes
+	_, err = f.Write(b)
+	return err
+}
+
+//checkStateLimits returns ErrInvalidLimits if a limit does not fit the record of the state format
+func checkStateLimits(l Limits) error {
+	if l.MaxSkippedKeys < 0 || uint64(l.MaxSkippedKeys) > math.MaxUint32 ||
+		l.ReplayWindow < 0 || uint64(l.ReplayWindow) > math.MaxUint32 || l.MaxSkippedAge < 0 {
+		return ErrInvalidLimits
+	}
+	return nil
+}
+
+//readState reads a state in the versioned format, it does not read past the end
+//of the state. The legacy layout is only read by axolotlMigrateLegacyState.
+func readState(f io.Reader) (*State, error) {
+	var head [4]byte
+	_, err := io.ReadFull(f, head[:])
+	if err != nil {
+		return nil, err
+	}
+	if head != stateMagic {
+		return nil, ErrInvalidState
+	}
+	_, err = io.ReadFull(f, head[0:1])
+	if err != nil {
+		return nil, err
+	}
+	if head[0] != stateVersion1 {
+		return nil, ErrUnsupportedVersion
+	}
+	return readStateV1(f)
+}
+
+func readStateV1(f io.Reader) (*State, error) {
+	s := &State{Limits: DefaultLimits}
+	skipped := NewMemorySkippedKeyStore()
+	s.skippedKeys = skipped
+	s.dhParams = &ecdh.ECDH{}
+	var haveAlgorithms bool
+	var hdr [5]byte
+	for {
+		_, err := io.ReadFull(f, hdr[:])
+		if err != nil {
+			return nil, err
+		}
+		tag := hdr[0]
+		n := binary.BigEndian.Uint32(hdr[1:5])
+		if tag == stateTagEnd {
+			if n != 0 {
+				return nil, ErrInvalidState
+			}
+			break
+		}
+		if n > maxStateRecord {
+			return nil, ErrInvalidState
+		}
+		var v []byte
+		if n > 0 {
+			v = make([]byte, n)
+			_, err = io.ReadFull(f, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		switch tag {
+		case stateTagAlgorithms:
+			if len(v) != 4 {
+				return nil, ErrInvalidState
+			}
+			s.CurveParam, s.StreamCipher, s.HKDF, s.HMAC = v[0], v[1], v[2], v[3]
+			haveAlgorithms = true
+		case stateTagFlags:
+			if len(v) != 2 {
+				return nil, ErrInvalidState
+			}
+			s.SenderSide = v[0] != 0
+			s.ratchetFlag = v[1] != 0
+		case stateTagCounters:
+			if len(v) != 16 {
+				return nil, ErrInvalidState
+			}
+			s.msgNumS = binary.BigEndian.Uint32(v[0:4])
+			s.msgNumR = binary.BigEndian.Uint32(v[4:8])
+			s.prevMsgNumS = binary.BigEndian.Uint32(v[8:12])
+			s.ratchetSteps = binary.BigEndian.Uint32(v[12:16])
+		case stateTagRootKey:
+			s.rootKey = v
+		case stateTagHeaderNonceSource:
+			s.headerNonceSource = v
+		case stateTagHdrKeyS:
+			s.hdrKeyS = v
+		case stateTagHdrKeyR:
+			s.hdrKeyR = v
+		case stateTagNextHdrKeyS:
+			s.nextHdrKeyS = v
+		case stateTagNextHdrKeyR:
+			s.nextHdrKeyR = v
+		case stateTagChainKeyS:
+			s.chainKeyS = v
+		case stateTagChainKeyR:
+			s.chainKeyR = v
+		case stateTagDHPrivateKey:
+			s.dhParams.PrivateKey = v
+		case stateTagDHPublicKey:
+			s.dhParams.PublicKey = v
+		case stateTagPeerDHPublicKey:
+			s.dhPublicKey = v
+		case stateTagSkippedKey:
+			k, err := parseSkippedKey(v)
+			if err != nil {
+				return nil, err
+			}
+			skipped.Put(k)
+		case stateTagSeenChain:
+			c, err := parseSeenChain(v)
+			if err != nil {
+				return nil, err
+			}
+			s.seen = append(s.seen, c)
+		case stateTagPQ:
+			if len(v) != 10 {
+				return nil, ErrInvalidState
+			}
+			s.pqRatchet = v[0] != 0
+			s.pqKEM = v[1]
+			s.pqInterval = binary.BigEndian.Uint32(v[2:6])
+			s.pqSteps = binary.BigEndian.Uint32(v[6:10])
+		case stateTagPQDecapKey:
+			s.pqDecapKey = v
+		case stateTagPQPeerEncapKey:
+			s.pqPeerEncapKey = v
+		case stateTagPQHeader:
+			s.pqHeader = v
+		case stateTagLimits:
+			if len(v) != 32 {
+				return nil, ErrInvalidState
+			}
+			maxSkippedKeys := uint64(binary.BigEndian.Uint32(v[4:8]))
+			maxSkippedAge := binary.BigEndian.Uint64(v[8:16])
+			replayWindow := uint64(binary.BigEndian.Uint32(v[28:32]))
+			if maxSkippedKeys > math.MaxInt || maxSkippedAge > math.MaxInt64 || replayWindow > math.MaxInt {
+				return nil, ErrInvalidState
+			}
+			s.Limits.MaxSkip = binary.BigEndian.Uint32(v[0:4])
+			s.Limits.MaxSkippedKeys = int(maxSkippedKeys)
+			s.Limits.MaxSkippedAge = time.Duration(maxSkippedAge)
+			s.Limits.MaxSkippedRatchetSteps = binary.BigEndian.Uint32(v[16:20])
+			s.Limits.MaxHeaderSize = binary.BigEndian.Uint32(v[20:24])
+			s.Limits.MaxMessageSize = binary.BigEndian.Uint32(v[24:28])
+			s.Limits.ReplayWindow = int(replayWindow)
+		case stateTagPadding:
+			if len(v) != 4 || binary.BigEndian.Uint32(v) > maxPadding {
+				return nil, ErrInvalidState
+			}
+			s.padding = binary.BigEndian.Uint32(v)
+		}
+	}
+	if !haveAlgorithms {
+		return nil, ErrInvalidState
+	}
+	return s, finishState(s)
+}
+
+//finishState resolves the algorithms of a state which has been read
+func finishState(s *State) error {
+	err := initAlgorithms(s)
+	if err != nil {
+		return err
+	}
+	s.dhParams.Curve = s.dh.curve
+	if s.pqRatchet {
+		kem, ok := kems[s.pqKEM]
+		if !ok {
+			return ErrUnknownKEM
+		}
+		s.kem = kem
+	}
+	return nil
+}
+
+//readLegacyState reads the unversioned layout FromFile of the first releases
+//expected: the algorithm ids, the flags and counters, eight keys of 32 bytes,
+//the length prefixed DH keys and the skipped header and message keys of 32
+//bytes each. The SaveTo of those releases never completed a file, so such files
+//can only have been written by other means. Keys have 32 bytes, so chains which
+//had advanced before the state was saved cannot be continued, the keys of fresh
+//chains are migrated intact. Skipped keys lack their message numbers, a state
+//holding any is rejected with ErrLegacySkippedKeys.
+func readLegacyState(f io.Reader) (*State, error) {
+	var buf [18]byte
+	s := &State{Limits: DefaultLimits}
+	_, err := io.ReadFull(f, buf[0:18])
+	if err != nil {
+		return nil, err
+	}
+
+	s.CurveParam = buf[0]
+	s.StreamCipher = buf[1]
+	s.HKDF = buf[2]
+	s.HMAC = buf[3]
+	//Those releases ran SHA-256 for the SHA-512 ids
+	if s.HKDF == HKDF_SHA_512 {
+		s.HKDF = HKDF_SHA_512_COMPAT
+	}
+	if s.HMAC == HMAC_SHA_512 {
+		s.HMAC = HMAC_SHA_512_COMPAT
+	}
+	s.SenderSide = buf[4] != 0
+	s.ratchetFlag = buf[5] != 0
+	s.msgNumS = binary.BigEndian.Uint32(buf[6:10])
+	s.msgNumR = binary.BigEndian.Uint32(buf[10:14])
+	s.prevMsgNumS = binary.BigEndian.Uint32(buf[14:18])
+
+	for _, k := range []*key{&s.rootKey, (*key)(&s.headerNonceSource), &s.hdrKeyS, &s.hdrKeyR,
+		&s.nextHdrKeyS, &s.nextHdrKeyR, &s.chainKeyS, &s.chainKeyR} {
+		*k = make(key, 32)
+		_, err = io.ReadFull(f, *k)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = io.ReadFull(f, buf[0:12])
+	if err != nil {
+		return nil, err
+	}
+	var lens [3]uint32
+	for i := range lens {
+		lens[i] = binary.BigEndian.Uint32(buf[4*i : 4*i+4])
+		if lens[i] > maxStateRecord {
+			return nil, ErrInvalidState
+		}
+	}
+	s.dhParams = &ecdh.ECDH{}
+	for i, k := range []*[]byte{&s.dhParams.PrivateKey, &s.dhParams.PublicKey, (*[]byte)(&s.dhPublicKey)} {
+		*k = make([]byte, lens[i])
+		_, err = io.ReadFull(f, *k)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = io.ReadFull(f, buf[0:4])
+	if err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(buf[0:4]) != 0 {
+		return nil, ErrLegacySkippedKeys
+	}
+	s.skippedKeys = NewMemorySkippedKeyStore()
+	return s, finishState(s)
+}
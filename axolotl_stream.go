@@ -0,0 +1,202 @@
+package axolotl
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+//A stream starts with a regular ratchet message carrying the chunk size,
+//authenticated with streamAD so it cannot be mistaken for a normal message. The
+//payload follows in chunks sealed by the stream cipher of the state with a key
+//derived from the message key of that ratchet message. The nonce of a chunk holds its counter and a
+//flag marking the final chunk (STREAM construction), so chunks cannot be
+//reordered, dropped or truncated without detection.
+//
+//Every chunk is framed by a flag byte and the length of the sealed chunk.
+const (
+	streamVersion1 = 1
+
+	streamChunkSize = 64 * 1024
+
+	//maxStreamChunkSize bounds the memory a received stream can claim
+	maxStreamChunkSize = 16 * 1024 * 1024
+
+	//maxStreamHeaderSize bounds the length of the ratchet message of a stream
+	maxStreamHeaderSize = 64 * 1024
+
+	streamFlagFinal = 1
+)
+
+var streamAD = []byte("axolotl stream")
+
+//noLock is used by the stream functions of a State, which is not safe for concurrent use anyway
+type noLock struct{}
+
+func (noLock) Lock()   {}
+func (noLock) Unlock() {}
+
+func streamNonce(size int, counter uint32, final bool) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint32(nonce[size-5:size-1], counter)
+	if final {
+		nonce[size-1] = streamFlagFinal
+	}
+	return nonce
+}
+
+//streamCipher returns the cipher of the state for the chunks of the stream whose
+//ratchet message has the message key mk if its nonce can hold the chunk counter
+func streamCipher(s *State, mk key) (cipher.AEAD, error) {
+	streamKey := make([]byte, 32)
+	_, err := io.ReadFull(s.hkdf(mk, nil, streamAD), streamKey)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroKey(streamKey)
+	aead, err := s.streamCipher(streamKey)
+	if err != nil {
+		return nil, err
+	}
+	if aead.NonceSize() < 8 {
+		return nil, ErrInvalidAlgorithm
+	}
+	return aead, nil
+}
+
+//axolotlEncryptStream encrypts r to w, l is held only while the ratchet message is encrypted
+func axolotlEncryptStream(s *State, w io.Writer, r io.Reader, randomData io.Reader, l sync.Locker) error {
+	hdr := make([]byte, 5)
+	hdr[0] = streamVersion1
+	binary.BigEndian.PutUint32(hdr[1:5], streamChunkSize)
+	l.Lock()
+	m, mk, err := encryptMessage(s, hdr, streamAD, randomData)
+	l.Unlock()
+	if err != nil {
+		return err
+	}
+	aead, err := streamCipher(s, mk)
+	zeroKey(mk)
+	if err != nil {
+		return err
+	}
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(m)))
+	_, err = w.Write(append(b, m...))
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	buf := make([]byte, streamChunkSize)
+	frame := make([]byte, 5, 5+streamChunkSize+aead.Overhead())
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(br, buf)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err == nil {
+			_, err = br.Peek(1)
+			final = err == io.EOF
+		}
+		if err != nil && !final {
+			return err
+		}
+		if counter == ^uint32(0) && !final {
+			return ErrStreamTooLong
+		}
+
+		frame = frame[:5]
+		frame[0] = 0
+		if final {
+			frame[0] = streamFlagFinal
+		}
+		frame = aead.Seal(frame, streamNonce(aead.NonceSize(), counter, final), buf[:n], nil)
+		binary.BigEndian.PutUint32(frame[1:5], uint32(len(frame)-5))
+		_, err = w.Write(frame)
+		if err != nil {
+			return err
+		}
+		if final {
+			zeroKey(buf)
+			return nil
+		}
+	}
+}
+
+//axolotlDecryptStream decrypts r to w, l is held only while the ratchet message is decrypted
+//Failures of the stream are returned as *DecryptError once its length has been read.
+func axolotlDecryptStream(s *State, w io.Writer, r io.Reader, l sync.Locker) error {
+	var b [5]byte
+	_, err := io.ReadFull(r, b[0:4])
+	if err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(b[0:4])
+	if n > maxStreamHeaderSize {
+		return decryptFailure(ErrMalformedMessage, 0, nil)
+	}
+	m := make([]byte, n)
+	_, err = io.ReadFull(r, m)
+	if err != nil {
+		return err
+	}
+	msg, err := deserialize(m, s.Limits)
+	if err != nil {
+		return decryptFailure(err, 0, nil)
+	}
+	l.Lock()
+	hdr, mk, err := decryptMessage(s, msg, streamAD)
+	l.Unlock()
+	defer zeroKey(mk)
+	if err != nil {
+		return err
+	}
+	if len(hdr) != 5 || hdr[0] != streamVersion1 {
+		return decryptFailure(ErrUnsupportedVersion, 0, nil)
+	}
+	chunkSize := binary.BigEndian.Uint32(hdr[1:5])
+	if chunkSize == 0 || chunkSize > maxStreamChunkSize {
+		return decryptFailure(ErrMalformedMessage, 0, nil)
+	}
+	aead, err := streamCipher(s, mk)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, int(chunkSize)+aead.Overhead())
+	for counter := uint32(0); ; counter++ {
+		_, err = io.ReadFull(r, b[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return decryptFailure(ErrTruncatedStream, 0, nil)
+		}
+		if err != nil {
+			return err
+		}
+		final := b[0] == streamFlagFinal
+		n := binary.BigEndian.Uint32(b[1:5])
+		if (b[0] != 0 && !final) || n > uint32(len(buf)) {
+			return decryptFailure(ErrMalformedMessage, 0, nil)
+		}
+		_, err = io.ReadFull(r, buf[:n])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return decryptFailure(ErrTruncatedStream, 0, nil)
+		}
+		if err != nil {
+			return err
+		}
+		pt, err := aead.Open(buf[:0], streamNonce(aead.NonceSize(), counter, final), buf[:n], nil)
+		if err != nil {
+			return decryptFailure(ErrBodyAuthentication, 0, nil)
+		}
+		_, err = w.Write(pt)
+		if err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+		if counter == ^uint32(0) {
+			return decryptFailure(ErrStreamTooLong, 0, nil)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package axolotl
+
+import (
+	"sync"
+)
+
+//Suite is a named combination of curve, stream cipher, key derivation function and MAC
+//The ID identifies the suite on the wire and must be stable, 0 is reserved for unnamed combinations
+type Suite struct {
+	ID     uint16
+	Name   string
+	Curve  uint8
+	Cipher uint8
+	KDF    uint8
+	MAC    uint8
+}
+
+//Predefined suites
+var (
+	SuiteX25519_SHA256_AESGCM256         = Suite{0x0001, "X25519_SHA256_AESGCM256", CurveX25519, AES_GCM_256, HKDF_SHA_256, HMAC_SHA_256}
+	SuiteX25519_SHA256_CHACHA20POLY1305  = Suite{0x0002, "X25519_SHA256_CHACHA20POLY1305", CurveX25519, CHACHA20_POLY1305, HKDF_SHA_256, HMAC_SHA_256}
+	SuiteX25519_SHA256_XCHACHA20POLY1305 = Suite{0x0003, "X25519_SHA256_XCHACHA20POLY1305", CurveX25519, XCHACHA20_POLY1305, HKDF_SHA_256, HMAC_SHA_256}
+	SuiteX448_SHA512_AESGCM256           = Suite{0x0004, "X448_SHA512_AESGCM256", CurveX448, AES_GCM_256, HKDF_SHA_512, HMAC_SHA_512}
+	SuiteX448_SHA512_CHACHA20POLY1305    = Suite{0x0005, "X448_SHA512_CHACHA20POLY1305", CurveX448, CHACHA20_POLY1305, HKDF_SHA_512, HMAC_SHA_512}
+	SuiteP256_SHA256_AESGCM128           = Suite{0x0006, "P256_SHA256_AESGCM128", CurveP256, AES_GCM_128, HKDF_SHA_256, HMAC_SHA_256}
+	SuiteP384_SHA384_AESGCM256           = Suite{0x0007, "P384_SHA384_AESGCM256", CurveP384, AES_GCM_256, HKDF_SHA_384, HMAC_SHA_384}
+	SuiteP521_SHA512_AESGCM256           = Suite{0x0008, "P521_SHA512_AESGCM256", CurveP521, AES_GCM_256, HKDF_SHA_512, HMAC_SHA_512}
+	SuiteX25519_SHA3_256_AESGCM256       = Suite{0x0009, "X25519_SHA3_256_AESGCM256", CurveX25519, AES_GCM_256, HKDF_SHA3_256, HMAC_SHA3_256}
+	SuiteX448_SHA3_512_XCHACHA20POLY1305 = Suite{0x000A, "X448_SHA3_512_XCHACHA20POLY1305", CurveX448, XCHACHA20_POLY1305, HKDF_SHA3_512, HMAC_SHA3_512}
+)
+
+var suiteLock sync.RWMutex
+
+var suitesByID = map[uint16]Suite{}
+var suitesByName = map[string]Suite{}
+
+func init() {
+	for _, s := range []Suite{
+		SuiteX25519_SHA256_AESGCM256,
+		SuiteX25519_SHA256_CHACHA20POLY1305,
+		SuiteX25519_SHA256_XCHACHA20POLY1305,
+		SuiteX448_SHA512_AESGCM256,
+		SuiteX448_SHA512_CHACHA20POLY1305,
+		SuiteP256_SHA256_AESGCM128,
+		SuiteP384_SHA384_AESGCM256,
+		SuiteP521_SHA512_AESGCM256,
+		SuiteX25519_SHA3_256_AESGCM256,
+		SuiteX448_SHA3_512_XCHACHA20POLY1305,
+	} {
+		suitesByID[s.ID] = s
+		suitesByName[s.Name] = s
+	}
+}
+
+//String returns the name of the suite
+func (s Suite) String() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return CurveName(s.Curve) + "/" + KDFName(s.KDF) + "/" + MACName(s.MAC) + "/" + CipherName(s.Cipher)
+}
+
+func registerSuite(s Suite) error {
+	if s.ID == 0 || s.Name == "" {
+		return ErrInvalidAlgorithm
+	}
+	err := validateSuite(s)
+	if err != nil {
+		return err
+	}
+	suiteLock.Lock()
+	defer suiteLock.Unlock()
+	if _, ok := suitesByID[s.ID]; ok {
+		return ErrAlgorithmRegistered
+	}
+	if _, ok := suitesByName[s.Name]; ok {
+		return ErrAlgorithmRegistered
+	}
+	suitesByID[s.ID] = s
+	suitesByName[s.Name] = s
+	return nil
+}
+
+//validateSuite checks that every algorithm of the suite is registered
+func validateSuite(s Suite) error {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	if _, ok := dhCurves[s.Curve]; !ok {
+		return ErrUnknownAlgorithm
+	}
+	if _, ok := streamCiphers[s.Cipher]; !ok {
+		return ErrUnknownAlgorithm
+	}
+	if _, ok := hkdfs[s.KDF]; !ok {
+		return ErrUnknownAlgorithm
+	}
+	if _, ok := hmacs[s.MAC]; !ok {
+		return ErrUnknownAlgorithm
+	}
+	return nil
+}
+
+func parseSuite(name string) (Suite, error) {
+	suiteLock.RLock()
+	defer suiteLock.RUnlock()
+	s, ok := suitesByName[name]
+	if !ok {
+		return Suite{}, ErrUnknownSuite
+	}
+	return s, nil
+}
+
+func suiteByID(id uint16) (Suite, error) {
+	suiteLock.RLock()
+	defer suiteLock.RUnlock()
+	s, ok := suitesByID[id]
+	if !ok {
+		return Suite{}, ErrUnknownSuite
+	}
+	return s, nil
+}
+
+//stateSuite returns the registered suite matching the algorithms of the state
+//or an unnamed suite with ID 0 if there is none. If several suites share the
+//algorithms the one with the lowest ID is returned, so both peers agree on it.
+func stateSuite(st *State) Suite {
+	suiteLock.RLock()
+	defer suiteLock.RUnlock()
+	found := Suite{Curve: st.CurveParam, Cipher: st.StreamCipher, KDF: st.HKDF, MAC: st.HMAC}
+	for _, s := range suitesByID {
+		if s.Curve == st.CurveParam && s.Cipher == st.StreamCipher && s.KDF == st.HKDF && s.MAC == st.HMAC &&
+			(found.ID == 0 || s.ID < found.ID) {
+			found = s
+		}
+	}
+	return found
+}
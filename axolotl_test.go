@@ -1,12 +1,26 @@
 package axolotl_test
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"github.com/arcpop/axolotl"
 	"github.com/arcpop/ecdh"
+	"golang.org/x/crypto/curve25519"
 	"io"
+	mrand "math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 var messagesFromAlice = []string{
@@ -116,3 +130,1611 @@ func TestAxolotl(t *testing.T) {
 	bobDec(t, Bob)
 	bobDec(t, Bob)
 }
+
+func converse(t *testing.T, alice, bob *axolotl.State) {
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 2; i++ {
+			msg := []byte(messagesFromAlice[round*2+i])
+			ct, err := alice.EncryptMessage(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pt, err := bob.DecryptMessageBuffer(ct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(pt) != string(msg) {
+				t.Fatal(string(pt), "!=", string(msg))
+			}
+		}
+		msg := []byte(messagesFromBob[round])
+		ct, err := bob.EncryptMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pt, err := alice.DecryptMessageBuffer(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pt) != string(msg) {
+			t.Fatal(string(pt), "!=", string(msg))
+		}
+	}
+}
+
+func newPair(t *testing.T, curve, streamCipher uint8) (*axolotl.State, *axolotl.State) {
+	mk := make([]byte, 32)
+	io.ReadFull(rand.Reader, mk)
+	dhParams, err := axolotl.GenerateKeyPair(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := axolotl.NewSender(curve, streamCipher, axolotl.HKDF_SHA_256, axolotl.HMAC_SHA_256, mk, dhParams.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := axolotl.NewReceiver(curve, streamCipher, axolotl.HKDF_SHA_256, axolotl.HMAC_SHA_256, mk, dhParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return alice, bob
+}
+
+func TestAxolotlCurves(t *testing.T) {
+	for _, curve := range []uint8{axolotl.CurveP256, axolotl.CurveX25519, axolotl.CurveX448} {
+		alice, bob := newPair(t, curve, axolotl.AES_GCM_256)
+		converse(t, alice, bob)
+	}
+}
+
+func TestAxolotlStreamCiphers(t *testing.T) {
+	for _, streamCipher := range []uint8{axolotl.AES_GCM_128, axolotl.CHACHA20_POLY1305, axolotl.XCHACHA20_POLY1305} {
+		alice, bob := newPair(t, axolotl.CurveX25519, streamCipher)
+		converse(t, alice, bob)
+	}
+}
+
+func TestAxolotlAssociatedData(t *testing.T) {
+	alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	ad := []byte("alice->bob")
+	ct, err := alice.EncryptMessageAD([]byte(messagesFromAlice[0]), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bob.DecryptMessageAD(ct, []byte("mallory->bob")); err == nil {
+		t.Fatal("decrypted with wrong associated data")
+	}
+	pt, err := bob.DecryptMessageAD(ct, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pt) != messagesFromAlice[0] {
+		t.Fatal(string(pt), "!=", messagesFromAlice[0])
+	}
+}
+
+func TestX3DH(t *testing.T) {
+	aliceID, err := axolotl.NewIdentityKey(axolotl.CurveX25519, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobID, err := axolotl.NewIdentityKey(axolotl.CurveX25519, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spk, err := axolotl.NewSignedPreKey(bobID, 1, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opks, err := axolotl.NewPreKeys(axolotl.CurveX25519, 100, 1, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := axolotl.DeserializePreKeyBundle(axolotl.NewPreKeyBundle(bobID, spk, opks[0]).Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, hs, err := axolotl.X3DHInitiate(aliceID, bundle, axolotl.AES_GCM_256, axolotl.HKDF_SHA_256, axolotl.HMAC_SHA_256, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err = axolotl.DeserializeX3DHMessage(hs.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := axolotl.X3DHRespond(bobID, spk, opks[0], hs, axolotl.AES_GCM_256, axolotl.HKDF_SHA_256, axolotl.HMAC_SHA_256, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ad := axolotl.X3DHAssociatedData(hs.IdentityKey, bundle.IdentityKey)
+	ct, err := alice.EncryptMessageAD([]byte(messagesFromAlice[0]), ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := bob.DecryptMessageAD(ct, ad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pt) != messagesFromAlice[0] {
+		t.Fatal(string(pt), "!=", messagesFromAlice[0])
+	}
+	converse(t, alice, bob)
+
+	bundle.SignedPreKeySignature[0] ^= 1
+	if _, _, err = axolotl.X3DHInitiate(aliceID, bundle, axolotl.AES_GCM_256, axolotl.HKDF_SHA_256, axolotl.HMAC_SHA_256, rand.Reader); err != axolotl.ErrInvalidSignature {
+		t.Fatal("expected ErrInvalidSignature, got", err)
+	}
+}
+
+func TestPQXDH(t *testing.T) {
+	aliceID, err := axolotl.NewIdentityKey(axolotl.CurveX25519, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobID, err := axolotl.NewIdentityKey(axolotl.CurveX25519, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spk, err := axolotl.NewSignedPreKey(bobID, 1, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pqpk, err := axolotl.NewPQPreKey(bobID, 2, axolotl.ML_KEM_768, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := axolotl.DeserializePreKeyBundle(axolotl.NewPQPreKeyBundle(bobID, spk, pqpk, nil).Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice, hs, err := axolotl.PQXDHInitiate(aliceID, bundle, axolotl.AES_GCM_256, axolotl.HKDF_SHA_256, axolotl.HMAC_SHA_256, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err = axolotl.DeserializeX3DHMessage(hs.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = axolotl.PQXDHRespond(bobID, spk, nil, nil, hs, axolotl.AES_GCM_256, axolotl.HKDF_SHA_256, axolotl.HMAC_SHA_256, rand.Reader); err != axolotl.ErrMissingPQPreKey {
+		t.Fatal("expected ErrMissingPQPreKey, got", err)
+	}
+	bob, err := axolotl.PQXDHRespond(bobID, spk, pqpk, nil, hs, axolotl.AES_GCM_256, axolotl.HKDF_SHA_256, axolotl.HMAC_SHA_256, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	converse(t, alice, bob)
+
+	//the handshake is reproducible from the random source passed in
+	var handshakes [][]byte
+	for i := 0; i < 2; i++ {
+		_, hs, err := axolotl.PQXDHInitiate(aliceID, bundle, axolotl.AES_GCM_256, axolotl.HKDF_SHA_256, axolotl.HMAC_SHA_256, mrand.NewChaCha8([32]byte{1}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		handshakes = append(handshakes, hs.Serialize())
+	}
+	if !bytes.Equal(handshakes[0], handshakes[1]) {
+		t.Fatal("handshakes from the same random source differ")
+	}
+}
+
+func TestPQRatchet(t *testing.T) {
+	for _, interval := range []uint32{1, 2} {
+		alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+		if err := alice.EnablePQRatchet(axolotl.ML_KEM_768, interval); err != nil {
+			t.Fatal(err)
+		}
+		if err := bob.EnablePQRatchet(axolotl.ML_KEM_768, interval); err != nil {
+			t.Fatal(err)
+		}
+		converse(t, alice, bob)
+		converse(t, alice, bob)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	const customCipher = 200
+	err := axolotl.RegisterCipher(customCipher, "AES-256-GCM-custom", func(key []byte) (cipher.AEAD, error) {
+		c, err := aes.NewCipher(key[0:32])
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(c)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer axolotl.UnregisterCipher(customCipher)
+	if err = axolotl.RegisterCipher(axolotl.AES_GCM_256, "other", streamCipherStub); err != axolotl.ErrAlgorithmRegistered {
+		t.Fatal("expected ErrAlgorithmRegistered, got", err)
+	}
+	if id, err := axolotl.LookupCipher("AES-256-GCM-custom"); err != nil || id != customCipher {
+		t.Fatal("lookup of registered cipher failed", id, err)
+	}
+	alice, bob := newPair(t, axolotl.CurveX25519, customCipher)
+	converse(t, alice, bob)
+
+	if _, err = axolotl.NewSender(axolotl.CurveX25519, 201, axolotl.HKDF_SHA_256, axolotl.HMAC_SHA_256, make([]byte, 32), nil); err != axolotl.ErrUnknownAlgorithm {
+		t.Fatal("expected ErrUnknownAlgorithm, got", err)
+	}
+
+	//a suite sharing the algorithms of a predefined one does not change the suite of states
+	alias := axolotl.SuiteX25519_SHA256_AESGCM256
+	alias.ID, alias.Name = 0x7F00, "X25519_SHA256_AESGCM256-alias"
+	if err = axolotl.RegisterSuite(alias); err != nil {
+		t.Fatal(err)
+	}
+	defer axolotl.UnregisterSuite(alias.ID)
+	alice, _ = newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	for i := 0; i < 16; i++ {
+		if id := alice.Suite().ID; id != axolotl.SuiteX25519_SHA256_AESGCM256.ID {
+			t.Fatal("expected the suite with the lowest id, got", id)
+		}
+	}
+
+	//a registered curve cannot derive public keys, its key pairs are checked by agreement
+	const customCurve = 200
+	err = axolotl.RegisterCurve(customCurve, "X25519-custom", func(randomData io.Reader) (*ecdh.ECDH, error) {
+		return axolotl.GenerateKeyPair(axolotl.CurveX25519, randomData)
+	}, func(params *ecdh.ECDH, publicKey []byte) ([]byte, error) {
+		return curve25519.X25519(params.PrivateKey, publicKey)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer axolotl.UnregisterCurve(customCurve)
+	suite := axolotl.Suite{Curve: customCurve, Cipher: axolotl.AES_GCM_256, KDF: axolotl.HKDF_SHA_256, MAC: axolotl.HMAC_SHA_256}
+	kp, err := axolotl.GenerateKeyPair(customCurve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := axolotl.GenerateKeyPair(customCurve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk := make([]byte, 32)
+	if _, err = axolotl.New(axolotl.RoleReceiver, axolotl.WithSuite(suite), axolotl.WithMasterKey(mk), axolotl.WithKeyPair(kp)); err != nil {
+		t.Fatal(err)
+	}
+	mismatched := &ecdh.ECDH{PrivateKey: kp.PrivateKey, PublicKey: other.PublicKey}
+	if _, err = axolotl.New(axolotl.RoleReceiver, axolotl.WithSuite(suite), axolotl.WithMasterKey(mk), axolotl.WithKeyPair(mismatched)); !errors.Is(err, axolotl.ErrInvalidKeyPair) {
+		t.Fatal("expected ErrInvalidKeyPair, got", err)
+	}
+}
+
+func streamCipherStub(key []byte) (cipher.AEAD, error) {
+	return nil, nil
+}
+
+func TestSuites(t *testing.T) {
+	suite, err := axolotl.ParseSuite("X25519_SHA256_CHACHA20POLY1305")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suite != axolotl.SuiteX25519_SHA256_CHACHA20POLY1305 {
+		t.Fatal("parsed", suite, "!=", axolotl.SuiteX25519_SHA256_CHACHA20POLY1305)
+	}
+	if _, err = axolotl.ParseSuite("X25519_ROT13"); err != axolotl.ErrUnknownSuite {
+		t.Fatal("expected ErrUnknownSuite, got", err)
+	}
+
+	mk := make([]byte, 32)
+	io.ReadFull(rand.Reader, mk)
+	dhParams, err := axolotl.GenerateKeyPair(suite.Curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := axolotl.NewSenderWithSuite(suite, mk, dhParams.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := axolotl.NewReceiverWithSuite(suite, mk, dhParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.Suite() != suite || bob.Suite().String() != suite.Name {
+		t.Fatal("state does not report its suite")
+	}
+	converse(t, alice, bob)
+
+	//the SHA-512 suites run SHA-512, the SHA-256 variant of earlier releases is kept apart
+	compat := axolotl.Suite{Curve: axolotl.CurveX448, Cipher: axolotl.AES_GCM_256, KDF: axolotl.HKDF_SHA_512_COMPAT, MAC: axolotl.HMAC_SHA_512_COMPAT}
+	for _, suites := range [][2]axolotl.Suite{
+		{axolotl.SuiteX448_SHA512_AESGCM256, axolotl.SuiteX448_SHA512_AESGCM256},
+		{compat, compat},
+		{axolotl.SuiteX448_SHA512_AESGCM256, compat},
+	} {
+		//the receiver zeroes its private key on the first ratchet step
+		if dhParams, err = axolotl.GenerateKeyPair(axolotl.CurveX448, rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+		if alice, err = axolotl.NewSenderWithSuite(suites[0], mk, dhParams.PublicKey); err != nil {
+			t.Fatal(err)
+		}
+		if bob, err = axolotl.NewReceiverWithSuite(suites[1], mk, dhParams); err != nil {
+			t.Fatal(err)
+		}
+		if suites[0] == suites[1] {
+			converse(t, alice, bob)
+			continue
+		}
+		ct, err := alice.EncryptMessage([]byte(messagesFromAlice[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = bob.DecryptMessageBuffer(ct); err == nil {
+			t.Fatal("SHA-512 and its SHA-256 compat variant interoperate")
+		}
+	}
+}
+
+func TestWireFormat(t *testing.T) {
+	alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	ct, err := alice.EncryptMessage([]byte(messagesFromAlice[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct[0] != 0x00 || ct[1] != 'A' || ct[2] != 'X' || ct[3] != 1 {
+		t.Fatal("message does not start with a version 1 envelope")
+	}
+	if suite := alice.Suite(); int(ct[4])<<8|int(ct[5]) != int(suite.ID) {
+		t.Fatal("envelope does not carry the suite id", suite.ID)
+	}
+
+	bumped := append([]byte(nil), ct...)
+	bumped[3] = 2
+	if _, err = bob.DecryptMessageBuffer(bumped); !errors.Is(err, axolotl.ErrUnsupportedVersion) {
+		t.Fatal("expected ErrUnsupportedVersion, got", err)
+	}
+	pt, err := bob.DecryptMessage(bytes.NewReader(ct))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pt) != messagesFromAlice[0] {
+		t.Fatal(string(pt), "!=", messagesFromAlice[0])
+	}
+}
+
+func TestLegacyWireFormat(t *testing.T) {
+	//Ciphertexts produced by the releases before the envelope was introduced.
+	mustHex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	mk := make([]byte, 32)
+	for i := range mk {
+		mk[i] = byte(i)
+	}
+	dhParams := &ecdh.ECDH{
+		Curve:      elliptic.P256(),
+		PrivateKey: mustHex("744cf469377eafd17f0af30d14096c7127f75755f9b8f9633abfc60822dd8200"),
+		PublicKey:  mustHex("044fa2ca9520d48d2cae03d5372f0efa68ff418330d7ec224b12d829602db76da961b19af79948cfdb64b64ef32c85260dbd85f84849b9240098e76edc26aed74a"),
+	}
+	bob, err := axolotl.NewReceiver(axolotl.CurveP256, axolotl.AES_GCM_256, axolotl.HKDF_SHA_256, axolotl.HMAC_SHA_256, mk, dhParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct0 := mustHex("0c0c000000590000002000000000a38df33380873518bd94881642a122923cc03dec36a9b66cb92eb7e8c26c267315d54d4bca88d7c22fd74c85cdcfddda3bab4d7ce42bebf7553e68591c128f7f98277257e0681f05693fade468aad846714ae9563ed305c2cc4e3a837367355ede7ede1dc7169c68a35185b80ced8a69a6418dc0fccdbc079baedc3b65e14c525306fdca8e261b022c4784ddc9")
+	ct1 := mustHex("0c0c000000590000002000000001a38df333808735189a8ce3461b4960c28738b82d263ad441c7899c8840981c4698e457500dee92f291c93767479a2da08f186e437bec7a084cabcd621ef8441068475446ef6285cfb871a0a9c957eea80ad91e77bc41afbf3c224c3e927eaa68f6d0ca936cf5b253ffd0578dc1fa401f0c6c9c1c18adf3b810a2feb4bd51bfe837ab73fd22cfb4423e9f855bc6")
+
+	pt, err := bob.DecryptMessageBuffer(ct0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pt) != "legacy message 0" {
+		t.Fatal(string(pt), "!= legacy message 0")
+	}
+	pt, err = bob.DecryptMessage(bytes.NewReader(ct1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pt) != "legacy message 1" {
+		t.Fatal(string(pt), "!= legacy message 1")
+	}
+
+	//legacy peers ran SHA-256 for the SHA-512 ids, states using SHA-512 reject their messages
+	kp, err := axolotl.GenerateKeyPair(axolotl.CurveX448, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := axolotl.New(axolotl.RoleSender, axolotl.WithSuite(axolotl.SuiteX448_SHA512_AESGCM256), axolotl.WithMasterKey(mk), axolotl.WithPeerPublicKey(kp.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err = axolotl.New(axolotl.RoleReceiver, axolotl.WithSuite(axolotl.SuiteX448_SHA512_AESGCM256), axolotl.WithMasterKey(mk), axolotl.WithKeyPair(kp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := alice.EncryptMessage([]byte(messagesFromAlice[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bob.DecryptMessageBuffer(ct[7:]); !errors.Is(err, axolotl.ErrUnknownSuite) {
+		t.Fatal("expected ErrUnknownSuite, got", err)
+	}
+	if _, err = bob.DecryptMessageBuffer(ct); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSkippedLimits(t *testing.T) {
+	alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	bob.Limits.MaxSkip = 3
+	bob.Limits.MaxSkippedKeys = 4
+
+	var cts [][]byte
+	for i := 0; i < 10; i++ {
+		ct, err := alice.EncryptMessage([]byte(messagesFromAlice[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cts = append(cts, ct)
+	}
+	if _, err := bob.DecryptMessageBuffer(cts[4]); !errors.Is(err, axolotl.ErrTooManySkipped) {
+		t.Fatal("expected ErrTooManySkipped, got", err)
+	}
+	for _, i := range []int{3, 7} {
+		if _, err := bob.DecryptMessageBuffer(cts[i]); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	//the keys of 0 and 1 were evicted to keep at most 4 stored keys
+	if _, err := bob.DecryptMessageBuffer(cts[0]); !errors.Is(err, axolotl.ErrExpiredMessage) {
+		t.Fatal("expected ErrExpiredMessage, got", err)
+	}
+	for _, i := range []int{2, 6, 5, 4} {
+		pt, err := bob.DecryptMessageBuffer(cts[i])
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if string(pt) != messagesFromAlice[i] {
+			t.Fatal(string(pt), "!=", messagesFromAlice[i])
+		}
+	}
+}
+
+func TestFileSkippedKeyStore(t *testing.T) {
+	alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	dir := t.TempDir()
+	store, err := axolotl.NewFileSkippedKeyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bob.SetSkippedKeyStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cts [][]byte
+	for i := 0; i < 5; i++ {
+		ct, err := alice.EncryptMessage([]byte(messagesFromAlice[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cts = append(cts, ct)
+	}
+	for _, i := range []int{4, 1, 3, 0, 2} {
+		pt, err := bob.DecryptMessageBuffer(cts[i])
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if string(pt) != messagesFromAlice[i] {
+			t.Fatal(string(pt), "!=", messagesFromAlice[i])
+		}
+		if i == 4 {
+			if n, err := store.Len(); err != nil || n != 4 {
+				t.Fatal("expected 4 stored keys, got", n, err)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil || len(entries) != 4 {
+				t.Fatal("expected 4 files, got", len(entries), err)
+			}
+			//the keys of a file store cannot be moved
+			if err = bob.SetSkippedKeyStore(axolotl.NewMemorySkippedKeyStore()); err != axolotl.ErrSkippedKeysNotMoved {
+				t.Fatal("expected ErrSkippedKeysNotMoved, got", err)
+			}
+		}
+	}
+	if n, err := store.Len(); err != nil || n != 0 {
+		t.Fatal("expected no stored keys, got", n, err)
+	}
+	if _, err := bob.DecryptMessageBuffer(cts[2]); !errors.Is(err, axolotl.ErrDuplicateMessage) {
+		t.Fatal("expected ErrDuplicateMessage, got", err)
+	}
+}
+
+func TestEncryptedState(t *testing.T) {
+	alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	kek := make([]byte, 32)
+	io.ReadFull(rand.Reader, kek)
+
+	var buf bytes.Buffer
+	err := alice.SaveEncrypted(&buf, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = axolotl.LoadEncrypted(bytes.NewReader(buf.Bytes()), make([]byte, 32)); err != axolotl.ErrInvalidState {
+		t.Fatal("expected ErrInvalidState, got", err)
+	}
+	alice, err = axolotl.LoadEncrypted(&buf, kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passphrase := []byte("correct horse battery staple")
+	err = bob.SaveEncryptedPassphrase(&buf, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := buf.Bytes()
+	if _, err = axolotl.LoadEncryptedPassphrase(bytes.NewReader(sealed), []byte("wrong")); err != axolotl.ErrInvalidState {
+		t.Fatal("expected ErrInvalidState, got", err)
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err = axolotl.LoadEncryptedPassphrase(bytes.NewReader(tampered), passphrase); err != axolotl.ErrInvalidState {
+		t.Fatal("expected ErrInvalidState, got", err)
+	}
+	bob, err = axolotl.LoadEncryptedPassphrase(bytes.NewReader(sealed), passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	converse(t, alice, bob)
+
+	//states sealed in the middle of advanced chains with a skipped message continue
+	skipped, err := alice.EncryptMessage([]byte(messagesFromAlice[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct, err := alice.EncryptMessage([]byte(messagesFromAlice[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bob.DecryptMessageBuffer(ct); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err = alice.SaveEncrypted(&buf, kek); err != nil {
+		t.Fatal(err)
+	}
+	if alice, err = axolotl.LoadEncrypted(&buf, kek); err != nil {
+		t.Fatal(err)
+	}
+	if err = bob.SaveEncryptedPassphrase(&buf, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	if bob, err = axolotl.LoadEncryptedPassphrase(&buf, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	pt, err := bob.DecryptMessageBuffer(skipped)
+	if err != nil || string(pt) != messagesFromAlice[0] {
+		t.Fatal("skipped message lost by sealing", err)
+	}
+	converse(t, alice, bob)
+}
+
+func TestStateFile(t *testing.T) {
+	alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	dir := t.TempDir()
+	fileName := dir + "/bob.state"
+	for i := 0; i < 2; i++ {
+		err := bob.SaveTo(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatal("expected only the state file, got", len(entries), "files")
+	}
+
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[10] ^= 1
+	err = os.WriteFile(dir+"/corrupt.state", b, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = axolotl.FromFile(dir + "/corrupt.state"); err != axolotl.ErrInvalidState {
+		t.Fatal("expected ErrInvalidState, got", err)
+	}
+
+	bob, err = axolotl.FromFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	converse(t, alice, bob)
+}
+
+func TestMarshalState(t *testing.T) {
+	alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	if err := alice.EnablePQRatchet(axolotl.ML_KEM_768, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.EnablePQRatchet(axolotl.ML_KEM_768, 1); err != nil {
+		t.Fatal(err)
+	}
+	converse(t, alice, bob)
+
+	var cts [][]byte
+	for i := 0; i < 3; i++ {
+		ct, err := alice.EncryptMessage([]byte(messagesFromAlice[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cts = append(cts, ct)
+	}
+	if _, err := bob.DecryptMessageBuffer(cts[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := alice.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice = &axolotl.State{}
+	err = alice.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = alice.UnmarshalBinary(append(b, 0)); err != axolotl.ErrInvalidState {
+		t.Fatal("expected ErrInvalidState, got", err)
+	}
+
+	//two states written to one stream are read back one after the other
+	var buf bytes.Buffer
+	if _, err = bob.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = alice.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	bob, err = axolotl.ReadState(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err = axolotl.ReadState(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Fatal(buf.Len(), "bytes left unread")
+	}
+
+	for _, i := range []int{0, 1} {
+		pt, err := bob.DecryptMessageBuffer(cts[i])
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if string(pt) != messagesFromAlice[i] {
+			t.Fatal(string(pt), "!=", messagesFromAlice[i])
+		}
+	}
+	converse(t, alice, bob)
+}
+
+func TestUnmarshalKeepsConfiguration(t *testing.T) {
+	alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	b, err := alice.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := &countingReader{r: rand.Reader}
+	alice.SetRandom(random)
+	session := axolotl.NewSession(alice)
+	if err = alice.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !alice.InSession() {
+		t.Fatal("state lost its session")
+	}
+	ct, err := session.EncryptMessage([]byte(messagesFromAlice[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if random.n == 0 {
+		t.Fatal("random source was not kept")
+	}
+	if _, err = bob.DecryptMessageBuffer(ct); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStateFormat(t *testing.T) {
+	alice, _ := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	b, err := alice.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//records with unknown tags are skipped
+	unknown := append([]byte{}, b[:len(b)-5]...)
+	unknown = append(unknown, 0xF0, 0, 0, 0, 3, 1, 2, 3)
+	unknown = append(unknown, b[len(b)-5:]...)
+	if err = (&axolotl.State{}).UnmarshalBinary(unknown); err != nil {
+		t.Fatal(err)
+	}
+
+	//the limits record has a single layout
+	const stateTagLimits = 20
+	short := append([]byte{}, b[:len(b)-5]...)
+	short = append(short, stateTagLimits, 0, 0, 0, 20)
+	short = append(short, make([]byte, 20)...)
+	short = append(short, b[len(b)-5:]...)
+	if err = (&axolotl.State{}).UnmarshalBinary(short); err != axolotl.ErrInvalidState {
+		t.Fatal("expected ErrInvalidState, got", err)
+	}
+	alice.Limits.ReplayWindow = -1
+	if _, err = alice.MarshalBinary(); err != axolotl.ErrInvalidLimits {
+		t.Fatal("expected ErrInvalidLimits, got", err)
+	}
+	alice.Limits.ReplayWindow = axolotl.DefaultLimits.ReplayWindow
+
+	future := append([]byte{}, b...)
+	future[4] = 0xFF
+	if err = (&axolotl.State{}).UnmarshalBinary(future); err != axolotl.ErrUnsupportedVersion {
+		t.Fatal("expected ErrUnsupportedVersion, got", err)
+	}
+
+	//a state in the legacy layout written by earlier releases
+	peer, err := axolotl.GenerateKeyPair(axolotl.CurveX25519, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := []byte{axolotl.CurveX25519, axolotl.AES_GCM_256, axolotl.HKDF_SHA_256, axolotl.HMAC_SHA_256, 1, 1}
+	legacy = append(legacy, make([]byte, 12)...)
+	keys := make([]byte, 8*32)
+	io.ReadFull(rand.Reader, keys)
+	legacy = append(legacy, keys...)
+	legacy = append(legacy, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, byte(len(peer.PublicKey)))
+	legacy = append(legacy, peer.PublicKey...)
+	legacy = append(legacy, 0, 0, 0, 0)
+
+	fileName := t.TempDir() + "/legacy.state"
+	migrate := func(b []byte) (*axolotl.State, error) {
+		t.Helper()
+		if err := os.WriteFile(fileName, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return axolotl.MigrateLegacyState(fileName)
+	}
+	if _, err = migrate(append(append([]byte{}, legacy...), 0)); err != axolotl.ErrInvalidState {
+		t.Fatal("expected ErrInvalidState for trailing data, got", err)
+	}
+	if _, err = migrate(legacy[:len(legacy)-1]); err != axolotl.ErrInvalidState {
+		t.Fatal("expected ErrInvalidState for a truncated file, got", err)
+	}
+	skipped := append(append([]byte{}, legacy[:len(legacy)-4]...), 0, 0, 0, 1)
+	if _, err = migrate(append(skipped, make([]byte, 64)...)); err != axolotl.ErrLegacySkippedKeys {
+		t.Fatal("expected ErrLegacySkippedKeys, got", err)
+	}
+	s, err := migrate(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//without the magic a file is never read as legacy state by FromFile
+	if _, err = axolotl.FromFile(fileName); err != axolotl.ErrInvalidState {
+		t.Fatal("expected ErrInvalidState, got", err)
+	}
+	if !s.SenderSide || s.Suite() != axolotl.SuiteX25519_SHA256_AESGCM256 {
+		t.Fatal("legacy state not migrated")
+	}
+	if _, err = s.EncryptMessage([]byte(messagesFromAlice[0])); err != nil {
+		t.Fatal(err)
+	}
+	err = s.SaveTo(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte("AXST")) {
+		t.Fatal("migrated state not saved in the versioned format")
+	}
+}
+
+func TestStateJSON(t *testing.T) {
+	alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	converse(t, alice, bob)
+	ct, err := alice.EncryptMessage([]byte(messagesFromAlice[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct2, err := alice.EncryptMessage([]byte(messagesFromAlice[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bob.DecryptMessageBuffer(ct2); err != nil {
+		t.Fatal(err)
+	}
+
+	redacted, err := bob.ExportJSON(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var j axolotl.StateJSON
+	err = json.Unmarshal(redacted, &j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Secrets != nil || j.Suite != "X25519_SHA256_AESGCM256" || j.MsgNumR != 2 || j.SkippedKeys != 1 {
+		t.Fatalf("unexpected export %s", redacted)
+	}
+	if !bytes.Contains(redacted, []byte(`"max_skipped_keys":`)) {
+		t.Fatalf("limits are not in snake case %s", redacted)
+	}
+	if _, err = axolotl.ImportJSON(redacted); err != axolotl.ErrInvalidState {
+		t.Fatal("expected ErrInvalidState, got", err)
+	}
+
+	full, err := bob.ExportJSON(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err = axolotl.ImportJSON(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt, err := bob.DecryptMessageBuffer(ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pt) != messagesFromAlice[0] {
+		t.Fatal(string(pt), "!=", messagesFromAlice[0])
+	}
+	converse(t, alice, bob)
+}
+
+func TestSessionManager(t *testing.T) {
+	dirStore, err := axolotl.NewDirectorySessionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, store := range []axolotl.SessionStore{axolotl.NewMemorySessionStore(), dirStore} {
+		m := axolotl.NewSessionManager(store, nil)
+		aliceAddr := axolotl.Address{Name: "alice@example.org", DeviceID: 1}
+		bobAddr := axolotl.Address{Name: "bob.example/org", DeviceID: 7}
+		if _, err = m.Encrypt(bobAddr, []byte("hi")); err != axolotl.ErrSessionNotFound {
+			t.Fatal("expected ErrSessionNotFound, got", err)
+		}
+
+		//alice's session with bob is stored under bob's address and vice versa
+		alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+		if err = m.Store(bobAddr, alice); err != nil {
+			t.Fatal(err)
+		}
+		if err = m.Store(aliceAddr, bob); err != nil {
+			t.Fatal(err)
+		}
+		addrs, err := m.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 2 || addrs[0] != aliceAddr || addrs[1] != bobAddr {
+			t.Fatal("unexpected addresses", addrs)
+		}
+
+		for i := 0; i < 4; i++ {
+			ct, err := m.Encrypt(bobAddr, []byte(messagesFromAlice[i]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pt, err := m.Decrypt(aliceAddr, ct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(pt) != messagesFromAlice[i] {
+				t.Fatal(string(pt), "!=", messagesFromAlice[i])
+			}
+			ct, err = m.Encrypt(aliceAddr, []byte(messagesFromBob[i]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pt, err = m.Decrypt(bobAddr, ct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(pt) != messagesFromBob[i] {
+				t.Fatal(string(pt), "!=", messagesFromBob[i])
+			}
+		}
+
+		//concurrent calls for an address are serialized, their locks are dropped afterwards
+		cts := make([][]byte, 8)
+		var wg sync.WaitGroup
+		for i := range cts {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				cts[i], _ = m.Encrypt(bobAddr, []byte(messagesFromAlice[i]))
+			}()
+		}
+		wg.Wait()
+		for _, ct := range cts {
+			if _, err = m.Decrypt(aliceAddr, ct); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := m.Locks(); n != 0 {
+			t.Fatal(n, "locks left")
+		}
+
+		if err = m.Delete(bobAddr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = store.Load(bobAddr); err != axolotl.ErrSessionNotFound {
+			t.Fatal("expected ErrSessionNotFound, got", err)
+		}
+	}
+}
+
+func TestSessionManagerPrepare(t *testing.T) {
+	store, err := axolotl.NewDirectorySessionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDir := t.TempDir()
+	prepare := func(addr axolotl.Address, s *axolotl.State) error {
+		skipped, err := axolotl.NewFileSkippedKeyStore(filepath.Join(keyDir, addr.String()))
+		if err != nil {
+			return err
+		}
+		return s.SetSkippedKeyStore(skipped)
+	}
+	m := axolotl.NewSessionManager(store, prepare)
+	aliceAddr := axolotl.Address{Name: "alice", DeviceID: 1}
+	bobAddr := axolotl.Address{Name: "bob", DeviceID: 1}
+	alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	if err = m.Store(bobAddr, alice); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Store(aliceAddr, bob); err != nil {
+		t.Fatal(err)
+	}
+
+	var cts [][]byte
+	for i := 0; i < 3; i++ {
+		ct, err := m.Encrypt(bobAddr, []byte(messagesFromAlice[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cts = append(cts, ct)
+	}
+	if _, err = m.Decrypt(aliceAddr, cts[2]); err != nil {
+		t.Fatal(err)
+	}
+	//the keys of the skipped messages live in the file store of the address
+	skipped, err := axolotl.NewFileSkippedKeyStore(filepath.Join(keyDir, aliceAddr.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := skipped.Len(); err != nil || n != 2 {
+		t.Fatal("expected 2 skipped keys, got", n, err)
+	}
+	for _, i := range []int{0, 1} {
+		pt, err := m.Decrypt(aliceAddr, cts[i])
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if string(pt) != messagesFromAlice[i] {
+			t.Fatal(string(pt), "!=", messagesFromAlice[i])
+		}
+	}
+	if n, err := skipped.Len(); err != nil || n != 0 {
+		t.Fatal("expected no skipped keys, got", n, err)
+	}
+
+	failing := errors.New("prepare failed")
+	m = axolotl.NewSessionManager(store, func(axolotl.Address, *axolotl.State) error { return failing })
+	if _, err = m.Encrypt(bobAddr, []byte("hi")); err != failing {
+		t.Fatal("expected the error of prepare, got", err)
+	}
+}
+
+func TestSessionConcurrency(t *testing.T) {
+	aliceState, bobState := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	alice, bob := axolotl.NewSession(aliceState), axolotl.NewSession(bobState)
+	//bob has to receive before he can send
+	ct, err := alice.EncryptMessage([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bob.DecryptMessageBuffer(ct); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, messages = 4, 20
+	toBob := make(chan []byte, workers*messages)
+	toAlice := make(chan []byte, workers*messages)
+	errs := make(chan error, 4*workers)
+	var wg sync.WaitGroup
+	send := func(s *axolotl.Session, out chan<- []byte) {
+		defer wg.Done()
+		for i := 0; i < messages; i++ {
+			ct, err := s.EncryptMessage([]byte(messagesFromAlice[i%len(messagesFromAlice)]))
+			if err != nil {
+				errs <- err
+				return
+			}
+			out <- ct
+		}
+	}
+	receive := func(s *axolotl.Session, in <-chan []byte) {
+		defer wg.Done()
+		for i := 0; i < messages; i++ {
+			if _, err := s.DecryptMessageBuffer(<-in); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(4)
+		go send(alice, toBob)
+		go send(bob, toAlice)
+		go receive(bob, toBob)
+		go receive(alice, toAlice)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < workers; i++ {
+			if _, err := alice.MarshalBinary(); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestDecryptFailureKeepsState(t *testing.T) {
+	alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	converse(t, alice, bob)
+
+	var cts [][]byte
+	for i := 0; i < 4; i++ {
+		ct, err := alice.EncryptMessage([]byte(messagesFromAlice[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cts = append(cts, ct)
+	}
+	garbage := make([]byte, 200)
+	io.ReadFull(rand.Reader, garbage)
+	tamper := func(ct []byte) []byte {
+		b := append([]byte{}, ct...)
+		b[len(b)-1] ^= 1
+		return b
+	}
+
+	expectUnchanged := func(bad ...[]byte) {
+		before, err := bob.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range bad {
+			if _, err = bob.DecryptMessageBuffer(b); err == nil {
+				t.Fatal("decrypted a forged message")
+			}
+		}
+		after, err := bob.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(before, after) {
+			t.Fatal("failed decryption changed the state")
+		}
+	}
+	decrypt := func(ct []byte, msg string) {
+		pt, err := bob.DecryptMessageBuffer(ct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(pt) != msg {
+			t.Fatal(string(pt), "!=", msg)
+		}
+	}
+
+	//the first message of a new chain triggers a DH ratchet step
+	expectUnchanged(garbage, cts[0][:len(cts[0])/2], tamper(cts[0]), tamper(cts[3]))
+	decrypt(cts[1], messagesFromAlice[1])
+	//a forged body must not skip keys of the current chain
+	expectUnchanged(garbage, tamper(cts[3]), tamper(cts[0]), cts[1])
+	decrypt(cts[3], messagesFromAlice[3])
+	decrypt(cts[0], messagesFromAlice[0])
+	decrypt(cts[2], messagesFromAlice[2])
+	converse(t, alice, bob)
+}
+
+func TestEncryptStream(t *testing.T) {
+	alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	converse(t, alice, bob)
+
+	payload := make([]byte, 3*1024*1024+123)
+	io.ReadFull(rand.Reader, payload)
+	encrypt := func() []byte {
+		var b bytes.Buffer
+		err := alice.EncryptStream(&b, bytes.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+
+	var pt bytes.Buffer
+	err := bob.DecryptStream(&pt, bytes.NewReader(encrypt()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pt.Bytes(), payload) {
+		t.Fatal("decrypted stream differs")
+	}
+
+	//the ratchet message, then frames of flag, length and a sealed 64KiB chunk
+	frames := func(b []byte) (int, int) {
+		return 4 + int(binary.BigEndian.Uint32(b)), 5 + 64*1024 + 16
+	}
+	ct := encrypt()
+	start, size := frames(ct)
+	truncated := ct[:len(ct)-(len(payload)%(64*1024)+5+16)]
+	var decryptErr *axolotl.DecryptError
+	if err = bob.DecryptStream(io.Discard, bytes.NewReader(truncated)); !errors.Is(err, axolotl.ErrTruncatedStream) || !errors.As(err, &decryptErr) {
+		t.Fatal("truncated stream not detected:", err)
+	}
+	ct = encrypt()
+	reordered := append([]byte{}, ct[:start]...)
+	reordered = append(reordered, ct[start+size:start+2*size]...)
+	reordered = append(reordered, ct[start:start+size]...)
+	reordered = append(reordered, ct[start+2*size:]...)
+	if err = bob.DecryptStream(io.Discard, bytes.NewReader(reordered)); !errors.Is(err, axolotl.ErrBodyAuthentication) {
+		t.Fatal("reordered stream not detected:", err)
+	}
+	ct = encrypt()
+	ct[start] = 1
+	if err = bob.DecryptStream(io.Discard, bytes.NewReader(ct)); !errors.Is(err, axolotl.ErrBodyAuthentication) {
+		t.Fatal("forged final flag not detected:", err)
+	}
+
+	var empty bytes.Buffer
+	err = axolotl.NewSession(alice).EncryptStream(&empty, bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pt.Reset()
+	err = axolotl.NewSession(bob).DecryptStream(&pt, &empty)
+	if err != nil || pt.Len() != 0 {
+		t.Fatal("empty stream failed:", err)
+	}
+}
+
+//countingReader counts the bytes read from it
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += n
+	return n, err
+}
+
+func TestMessageSizeLimits(t *testing.T) {
+	alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	converse(t, alice, bob)
+
+	ct, err := alice.EncryptMessage([]byte(messagesFromAlice[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//envelope, nonce sizes, header length and message length
+	const prefix = 7 + 10
+	hostile := func(headerLength, messageLength uint32) []byte {
+		b := append([]byte{}, ct[:prefix]...)
+		binary.BigEndian.PutUint32(b[prefix-8:prefix-4], headerLength)
+		binary.BigEndian.PutUint32(b[prefix-4:prefix], messageLength)
+		return b
+	}
+	for _, c := range []struct {
+		b    []byte
+		part string
+	}{
+		{hostile(0xffffffff, 16), "header"},
+		{hostile(64, 0xffffffff), "message"},
+		{hostile(0xffffffff, 0xffffffff), "header"},
+	} {
+		//the claimed data never ends, it must not be read at all
+		r := &countingReader{r: io.MultiReader(bytes.NewReader(c.b), rand.Reader)}
+		_, err = bob.DecryptMessage(r)
+		var tooLarge *axolotl.MessageTooLargeError
+		if !errors.As(err, &tooLarge) || !errors.Is(err, axolotl.ErrMessageTooLarge) || tooLarge.Part != c.part {
+			t.Fatal("hostile length not rejected:", err)
+		}
+		if r.n != prefix {
+			t.Fatal("read", r.n, "bytes of a hostile message")
+		}
+		if _, err = bob.DecryptMessageBuffer(c.b); !errors.Is(err, axolotl.ErrMessageTooLarge) {
+			t.Fatal("hostile length not rejected:", err)
+		}
+	}
+
+	bob.Limits.MaxMessageSize = 8
+	if _, err = bob.DecryptMessage(bytes.NewReader(ct)); !errors.Is(err, axolotl.ErrMessageTooLarge) {
+		t.Fatal("message above the limit accepted:", err)
+	}
+	bob.Limits.MaxMessageSize = 0
+	pt, err := bob.DecryptMessage(bytes.NewReader(ct))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pt) != messagesFromAlice[0] {
+		t.Fatal(string(pt), "!=", messagesFromAlice[0])
+	}
+}
+
+func TestNew(t *testing.T) {
+	mk := make([]byte, 32)
+	io.ReadFull(rand.Reader, mk)
+	kp, err := axolotl.GenerateKeyPair(axolotl.CurveX25519, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := axolotl.GenerateKeyPair(axolotl.CurveX25519, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatched := &ecdh.ECDH{PrivateKey: kp.PrivateKey, PublicKey: other.PublicKey}
+	for _, c := range []struct {
+		role   axolotl.Role
+		opts   []axolotl.Option
+		option string
+		err    error
+	}{
+		{axolotl.RoleSender, nil, "master key", axolotl.ErrMissingOption},
+		{axolotl.RoleSender, []axolotl.Option{axolotl.WithMasterKey(mk[:16])}, "master key", axolotl.ErrInvalidKeyLength},
+		{axolotl.RoleSender, []axolotl.Option{axolotl.WithMasterKey(mk)}, "peer public key", axolotl.ErrMissingOption},
+		{axolotl.RoleSender, []axolotl.Option{axolotl.WithMasterKey(mk), axolotl.WithPeerPublicKey(make([]byte, 32))}, "peer public key", axolotl.ErrInvalidPublicKey},
+		{axolotl.RoleSender, []axolotl.Option{axolotl.WithMasterKey(mk), axolotl.WithPeerPublicKey(kp.PublicKey), axolotl.WithKeyPair(kp)}, "key pair", axolotl.ErrInvalidOption},
+		{axolotl.RoleReceiver, []axolotl.Option{axolotl.WithMasterKey(mk)}, "key pair", axolotl.ErrMissingOption},
+		{axolotl.RoleReceiver, []axolotl.Option{axolotl.WithKeyPair(nil)}, "key pair", axolotl.ErrInvalidKeyPair},
+		{axolotl.RoleReceiver, []axolotl.Option{axolotl.WithMasterKey(mk), axolotl.WithKeyPair(kp), axolotl.WithSuite(axolotl.SuiteX448_SHA512_AESGCM256)}, "key pair", axolotl.ErrInvalidKeyPair},
+		{axolotl.RoleReceiver, []axolotl.Option{axolotl.WithMasterKey(mk), axolotl.WithKeyPair(mismatched)}, "key pair", axolotl.ErrInvalidKeyPair},
+		{axolotl.RoleReceiver, []axolotl.Option{axolotl.WithSuite(axolotl.Suite{Curve: 200})}, "suite", axolotl.ErrUnknownAlgorithm},
+		{axolotl.RoleReceiver, []axolotl.Option{axolotl.WithRandom(nil)}, "random", axolotl.ErrInvalidOption},
+		{axolotl.RoleReceiver, []axolotl.Option{axolotl.WithClock(nil)}, "clock", axolotl.ErrInvalidOption},
+		{axolotl.RoleReceiver, []axolotl.Option{axolotl.WithPadding(0)}, "padding", axolotl.ErrInvalidOption},
+		{axolotl.RoleReceiver, []axolotl.Option{axolotl.WithLimits(axolotl.Limits{MaxSkippedKeys: -1})}, "limits", axolotl.ErrInvalidOption},
+		{0, []axolotl.Option{axolotl.WithMasterKey(mk)}, "role", axolotl.ErrInvalidOption},
+	} {
+		_, err = axolotl.New(c.role, c.opts...)
+		var configErr *axolotl.ConfigError
+		if !errors.As(err, &configErr) || configErr.Option != c.option || !errors.Is(err, c.err) {
+			t.Fatal("expected", c.option, c.err, "got", err)
+		}
+	}
+	if _, err = axolotl.NewReceiver(axolotl.CurveX25519, axolotl.AES_GCM_256, axolotl.HKDF_SHA_256, axolotl.HMAC_SHA_256, mk, nil); err != axolotl.ErrInvalidKeyPair {
+		t.Fatal("expected ErrInvalidKeyPair, got", err)
+	}
+	if _, err = axolotl.NewSender(axolotl.CurveX25519, axolotl.AES_GCM_256, axolotl.HKDF_SHA_256, axolotl.HMAC_SHA_256, mk[:8], kp.PublicKey); err != axolotl.ErrInvalidKeyLength {
+		t.Fatal("expected ErrInvalidKeyLength, got", err)
+	}
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	alice, err := axolotl.New(axolotl.RoleSender, axolotl.WithMasterKey(mk), axolotl.WithPeerPublicKey(kp.PublicKey),
+		axolotl.WithSuite(axolotl.SuiteX25519_SHA256_CHACHA20POLY1305), axolotl.WithPadding(256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := axolotl.New(axolotl.RoleReceiver, axolotl.WithMasterKey(mk), axolotl.WithKeyPair(kp),
+		axolotl.WithSuite(axolotl.SuiteX25519_SHA256_CHACHA20POLY1305), axolotl.WithClock(clock),
+		axolotl.WithLimits(axolotl.Limits{MaxSkippedAge: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := axolotl.DefaultLimits
+	limits.MaxSkippedAge = time.Hour
+	if bob.Limits != limits {
+		t.Fatal("limits not merged over the defaults:", bob.Limits)
+	}
+	converse(t, alice, bob)
+
+	//padding survives persistence and hides the length of short messages
+	b, err := alice.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice = &axolotl.State{}
+	if err = alice.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	var cts [][]byte
+	for _, msg := range []string{"", "a", messagesFromAlice[0], messagesFromAlice[1]} {
+		ct, err := alice.EncryptMessage([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cts = append(cts, ct)
+	}
+	for i := 1; i < len(cts); i++ {
+		if len(cts[i]) != len(cts[0]) {
+			t.Fatal("padded messages differ in length")
+		}
+	}
+	if pt, err := bob.DecryptMessageBuffer(cts[1]); err != nil || string(pt) != "a" {
+		t.Fatal("padded message not decrypted:", err)
+	}
+
+	//the clock of the state ages the key of the skipped message 0
+	now = now.Add(2 * time.Hour)
+	if _, err = bob.DecryptMessageBuffer(cts[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bob.DecryptMessageBuffer(cts[0]); !errors.Is(err, axolotl.ErrExpiredMessage) {
+		t.Fatal("expected ErrExpiredMessage, got", err)
+	}
+}
+
+//deterministicTranscript runs a session with the post-quantum ratchet, a
+//skipped message and a stream on randomness and a clock derived from seed. It
+//returns the messages sent and the states the session ends in.
+func deterministicTranscript(t *testing.T, seed byte) ([]byte, []byte) {
+	random := mrand.NewChaCha8([32]byte{seed})
+	clock := func() time.Time { return time.Unix(1700000000, 0) }
+	mk := make([]byte, 32)
+	io.ReadFull(random, mk)
+	kp, err := axolotl.GenerateKeyPair(axolotl.CurveX25519, random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := axolotl.New(axolotl.RoleSender, axolotl.WithMasterKey(mk), axolotl.WithPeerPublicKey(kp.PublicKey),
+		axolotl.WithRandom(random), axolotl.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := axolotl.NewReceiverWithSuite(axolotl.SuiteX25519_SHA256_AESGCM256, mk, kp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.SetRandom(random)
+	bob.SetClock(clock)
+	for _, s := range []*axolotl.State{alice, bob} {
+		if err = s.EnablePQRatchet(axolotl.ML_KEM_768, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var transcript []byte
+	send := func(from, to *axolotl.State, msg string, deliver bool) []byte {
+		ct, err := from.EncryptMessage([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		transcript = append(transcript, ct...)
+		if deliver {
+			if _, err = to.DecryptMessageBuffer(ct); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return ct
+	}
+	for round := 0; round < 3; round++ {
+		skipped := send(alice, bob, messagesFromAlice[round*2], false)
+		send(alice, bob, messagesFromAlice[round*2+1], true)
+		send(bob, alice, messagesFromBob[round], true)
+		if _, err = bob.DecryptMessageBuffer(skipped); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var stream bytes.Buffer
+	if err = alice.EncryptStream(&stream, bytes.NewReader(make([]byte, 100000))); err != nil {
+		t.Fatal(err)
+	}
+	transcript = append(transcript, stream.Bytes()...)
+	var states []byte
+	for _, s := range []*axolotl.State{alice, bob} {
+		b, err := s.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, b...)
+	}
+	return transcript, states
+}
+
+func TestDeterministicSession(t *testing.T) {
+	transcript, states := deterministicTranscript(t, 1)
+	transcript2, states2 := deterministicTranscript(t, 1)
+	if !bytes.Equal(transcript, transcript2) || !bytes.Equal(states, states2) {
+		t.Fatal("the same randomness produced different transcripts")
+	}
+	if transcript2, _ = deterministicTranscript(t, 2); bytes.Equal(transcript, transcript2) {
+		t.Fatal("different randomness produced the same transcript")
+	}
+	//known answer of the messages on the wire, changes whenever the wire format changes
+	const known = "d5b3c67fed3f1c5a8e4436cb1a6aff204e3e73bdc2c91052579ecf4cd033787e"
+	if sum := sha256.Sum256(transcript); hex.EncodeToString(sum[:]) != known {
+		t.Fatal("transcript hash", hex.EncodeToString(sum[:]), "!=", known)
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	converse(t, alice, bob)
+
+	expect := func(err, kind error, headerKnown bool) {
+		t.Helper()
+		var decryptErr *axolotl.DecryptError
+		if !errors.As(err, &decryptErr) || !errors.Is(err, kind) || !errors.Is(err, axolotl.ErrUndecryptable) {
+			t.Fatal("expected", kind, "got", err)
+		}
+		if (decryptErr.RatchetKey != nil) != headerKnown {
+			t.Fatal("unexpected ratchet key in", err)
+		}
+	}
+	encrypt := func(s *axolotl.State, msg string) []byte {
+		ct, err := s.EncryptMessage([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ct
+	}
+
+	ct := encrypt(alice, messagesFromAlice[0])
+	_, err := bob.DecryptMessageBuffer(ct[:12])
+	expect(err, axolotl.ErrMalformedMessage, false)
+	//a reader ending within the message can be retried
+	if _, err = bob.DecryptMessage(bytes.NewReader(ct[:len(ct)-1])); err != io.ErrUnexpectedEOF {
+		t.Fatal("expected io.ErrUnexpectedEOF, got", err)
+	}
+	if _, err = bob.DecryptMessage(bytes.NewReader(nil)); err != io.EOF {
+		t.Fatal("expected io.EOF, got", err)
+	}
+
+	suite := append([]byte{}, ct...)
+	suite[5] ^= 0xff
+	_, err = bob.DecryptMessageBuffer(suite)
+	expect(err, axolotl.ErrUnknownSuite, false)
+
+	other, _ := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	_, err = bob.DecryptMessageBuffer(encrypt(other, messagesFromAlice[0]))
+	expect(err, axolotl.ErrHeaderAuthentication, false)
+
+	body := append([]byte{}, ct...)
+	body[len(body)-1] ^= 1
+	_, err = bob.DecryptMessageBuffer(body)
+	expect(err, axolotl.ErrBodyAuthentication, true)
+
+	if _, err = bob.DecryptMessageBuffer(ct); err != nil {
+		t.Fatal(err)
+	}
+	_, err = bob.DecryptMessageBuffer(ct)
+	expect(err, axolotl.ErrDuplicateMessage, true)
+	var decryptErr *axolotl.DecryptError
+	errors.As(err, &decryptErr)
+	next := encrypt(alice, messagesFromAlice[1])
+	if _, err = bob.DecryptMessageBuffer(next); err != nil {
+		t.Fatal(err)
+	}
+	_, err = bob.DecryptMessageBuffer(next)
+	var nextErr *axolotl.DecryptError
+	if !errors.As(err, &nextErr) || nextErr.MessageNumber != decryptErr.MessageNumber+1 || !bytes.Equal(nextErr.RatchetKey, decryptErr.RatchetKey) {
+		t.Fatal("unexpected message number or ratchet key in", err)
+	}
+
+	bob.Limits.MaxSkip = 2
+	for i := 0; i < 3; i++ {
+		encrypt(alice, messagesFromAlice[i])
+	}
+	_, err = bob.DecryptMessageBuffer(encrypt(alice, messagesFromAlice[3]))
+	expect(err, axolotl.ErrTooManySkipped, true)
+
+	//bob loses the reply he sent after restoring an older state
+	b, err := bob.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = alice.DecryptMessageBuffer(encrypt(bob, messagesFromBob[0])); err != nil {
+		t.Fatal(err)
+	}
+	restored := &axolotl.State{}
+	if err = restored.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	_, err = restored.DecryptMessageBuffer(encrypt(alice, messagesFromAlice[0]))
+	expect(err, axolotl.ErrStaleSession, true)
+}
+
+func TestReplayDetection(t *testing.T) {
+	alice, bob := newPair(t, axolotl.CurveX25519, axolotl.AES_GCM_256)
+	converse(t, alice, bob)
+
+	var cts [][]byte
+	for i := 0; i < 3; i++ {
+		ct, err := alice.EncryptMessage([]byte(messagesFromAlice[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cts = append(cts, ct)
+	}
+	decrypt := func(s *axolotl.State, ct []byte) {
+		if _, err := s.DecryptMessageBuffer(ct); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(s *axolotl.State, ct []byte, kind error) {
+		t.Helper()
+		if _, err := s.DecryptMessageBuffer(ct); !errors.Is(err, kind) {
+			t.Fatal("expected", kind, "got", err)
+		}
+	}
+	//message 0 is decrypted with a skipped key
+	for _, i := range []int{1, 0, 2} {
+		decrypt(bob, cts[i])
+	}
+	for _, ct := range cts {
+		expect(bob, ct, axolotl.ErrDuplicateMessage)
+	}
+	//a replayed header with another body is a forgery, not a duplicate
+	forged := append([]byte{}, cts[1]...)
+	forged[len(forged)-1] ^= 1
+	expect(bob, forged, axolotl.ErrBodyAuthentication)
+	forged = append([]byte{}, cts[1]...)
+	forged[len(forged)/2] ^= 1
+	expect(bob, forged, axolotl.ErrUndecryptable)
+	if _, err := bob.DecryptMessageAD(cts[1], []byte("other")); errors.Is(err, axolotl.ErrDuplicateMessage) {
+		t.Fatal("duplicate detected with other associated data")
+	}
+
+	//the chain of cts has been replaced, the window still knows its messages
+	converse(t, alice, bob)
+	for _, ct := range cts {
+		expect(bob, ct, axolotl.ErrDuplicateMessage)
+	}
+
+	//the window survives persistence
+	b, err := bob.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := &axolotl.State{}
+	if err = restored.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	expect(restored, cts[0], axolotl.ErrDuplicateMessage)
+	j, err := bob.ExportJSON(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored, err = axolotl.ImportJSON(j); err != nil {
+		t.Fatal(err)
+	}
+	expect(restored, cts[2], axolotl.ErrDuplicateMessage)
+
+	//replays of chains dropped from the window cannot be told from forgeries
+	bob.Limits.ReplayWindow = 2
+	ct, err := alice.EncryptMessage([]byte(messagesFromAlice[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypt(bob, ct)
+	expect(bob, ct, axolotl.ErrDuplicateMessage)
+	expect(bob, cts[0], axolotl.ErrHeaderAuthentication)
+}
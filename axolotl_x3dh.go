@@ -0,0 +1,549 @@
+package axolotl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"github.com/arcpop/ecdh"
+	"io"
+)
+
+//IdentityKey is the long term key pair of a party taking part in the X3DH key agreement
+//DH is used in the key agreement, SigningKey signs the prekeys published in a PreKeyBundle
+type IdentityKey struct {
+	CurveParam uint8
+	DH         *ecdh.ECDH
+	SigningKey ed25519.PrivateKey
+}
+
+//PreKey is a one-time prekey, every one-time prekey must only be used for a single handshake
+type PreKey struct {
+	ID uint32
+	DH *ecdh.ECDH
+}
+
+//SignedPreKey is a medium term prekey signed by the identity key
+type SignedPreKey struct {
+	PreKey
+	Signature []byte
+}
+
+//PQPreKey is a signed post-quantum prekey used by the PQXDH handshake
+//DecapsulationKey is the secret seed, EncapsulationKey is published in the PreKeyBundle
+type PQPreKey struct {
+	ID               uint32
+	KEM              uint8
+	DecapsulationKey []byte
+	EncapsulationKey []byte
+	Signature        []byte
+}
+
+//PreKeyBundle contains the public keys the responder publishes so initiators can start a session
+//OneTimePreKey is empty if the responder ran out of one-time prekeys
+//PQPreKey is empty if the responder does not support PQXDH
+type PreKeyBundle struct {
+	CurveParam            uint8
+	IdentityKey           []byte
+	IdentitySigningKey    ed25519.PublicKey
+	SignedPreKeyID        uint32
+	SignedPreKey          []byte
+	SignedPreKeySignature []byte
+	OneTimePreKeyID       uint32
+	OneTimePreKey         []byte
+	KEM                   uint8
+	PQPreKeyID            uint32
+	PQPreKey              []byte
+	PQPreKeySignature     []byte
+}
+
+//X3DHMessage is sent by the initiator together with its first message
+//It tells the responder which of its prekeys were used, for PQXDH it also carries the KEM ciphertext
+type X3DHMessage struct {
+	IdentityKey      []byte
+	EphemeralKey     []byte
+	SignedPreKeyID   uint32
+	HasOneTimePreKey bool
+	OneTimePreKeyID  uint32
+	PQPreKeyID       uint32
+	KEMCiphertext    []byte
+}
+
+var x3dhInfo = []byte("axolotl X3DH")
+var pqxdhInfo = []byte("axolotl PQXDH")
+var signedPreKeyPrefix = []byte("axolotl signed prekey")
+var pqPreKeyPrefix = []byte("axolotl pq prekey")
+
+func x3dhNewIdentityKey(curveParam uint8, randomData io.Reader) (*IdentityKey, error) {
+	c, err := lookupCurve(curveParam)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := c.generate(randomData)
+	if err != nil {
+		return nil, err
+	}
+	_, sk, err := ed25519.GenerateKey(randomData)
+	if err != nil {
+		return nil, err
+	}
+	return &IdentityKey{CurveParam: curveParam, DH: dh, SigningKey: sk}, nil
+}
+
+func signedPreKeyMessage(curveParam uint8, id uint32, publicKey []byte) []byte {
+	b := make([]byte, 0, len(signedPreKeyPrefix)+5+len(publicKey))
+	b = append(b, signedPreKeyPrefix...)
+	b = append(b, curveParam)
+	b = binary.BigEndian.AppendUint32(b, id)
+	return append(b, publicKey...)
+}
+
+func x3dhNewSignedPreKey(ik *IdentityKey, id uint32, randomData io.Reader) (*SignedPreKey, error) {
+	c, err := lookupCurve(ik.CurveParam)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := c.generate(randomData)
+	if err != nil {
+		return nil, err
+	}
+	sig := ed25519.Sign(ik.SigningKey, signedPreKeyMessage(ik.CurveParam, id, dh.PublicKey))
+	return &SignedPreKey{PreKey: PreKey{ID: id, DH: dh}, Signature: sig}, nil
+}
+
+func x3dhNewPQPreKey(ik *IdentityKey, id uint32, KEM uint8, randomData io.Reader) (*PQPreKey, error) {
+	k, ok := kems[KEM]
+	if !ok {
+		return nil, ErrUnknownKEM
+	}
+	dk, ek, err := k.generate(randomData)
+	if err != nil {
+		return nil, err
+	}
+	sig := ed25519.Sign(ik.SigningKey, pqPreKeyMessage(KEM, id, ek))
+	return &PQPreKey{ID: id, KEM: KEM, DecapsulationKey: dk, EncapsulationKey: ek, Signature: sig}, nil
+}
+
+func pqPreKeyMessage(KEM uint8, id uint32, ek []byte) []byte {
+	b := make([]byte, 0, len(pqPreKeyPrefix)+5+len(ek))
+	b = append(b, pqPreKeyPrefix...)
+	b = append(b, KEM)
+	b = binary.BigEndian.AppendUint32(b, id)
+	return append(b, ek...)
+}
+
+func x3dhNewPreKeys(curveParam uint8, firstID uint32, n int, randomData io.Reader) ([]*PreKey, error) {
+	c, err := lookupCurve(curveParam)
+	if err != nil {
+		return nil, err
+	}
+	pks := make([]*PreKey, n)
+	for i := range pks {
+		dh, err := c.generate(randomData)
+		if err != nil {
+			return nil, err
+		}
+		pks[i] = &PreKey{ID: firstID + uint32(i), DH: dh}
+	}
+	return pks, nil
+}
+
+func x3dhNewPreKeyBundle(ik *IdentityKey, spk *SignedPreKey, pqpk *PQPreKey, opk *PreKey) *PreKeyBundle {
+	b := &PreKeyBundle{
+		CurveParam:            ik.CurveParam,
+		IdentityKey:           ik.DH.PublicKey,
+		IdentitySigningKey:    ik.SigningKey.Public().(ed25519.PublicKey),
+		SignedPreKeyID:        spk.ID,
+		SignedPreKey:          spk.DH.PublicKey,
+		SignedPreKeySignature: spk.Signature,
+	}
+	if opk != nil {
+		b.OneTimePreKeyID = opk.ID
+		b.OneTimePreKey = opk.DH.PublicKey
+	}
+	if pqpk != nil {
+		b.KEM = pqpk.KEM
+		b.PQPreKeyID = pqpk.ID
+		b.PQPreKey = pqpk.EncapsulationKey
+		b.PQPreKeySignature = pqpk.Signature
+	}
+	return b
+}
+
+//x3dhFiller returns the 0xFF filler prepended to the DH outputs, its length
+//matches the encoding size of the curve's keys like in the Signal specification
+func x3dhFiller(curveParam uint8) []byte {
+	n := 32
+	if curveParam == CurveX448 {
+		n = 57
+	}
+	return bytes.Repeat([]byte{0xFF}, n)
+}
+
+func x3dhDeriveMasterKey(HKDF uint8, km []byte, info []byte) ([]byte, error) {
+	hkdf, err := lookupKDF(HKDF)
+	if err != nil {
+		return nil, err
+	}
+	kdf := hkdf(km, make([]byte, 32), info)
+	zeroKey(km)
+	masterKey := make([]byte, 32)
+	_, err = io.ReadFull(kdf, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return masterKey, nil
+}
+
+func verifyPreKeyBundle(bundle *PreKeyBundle) error {
+	if len(bundle.IdentitySigningKey) != ed25519.PublicKeySize {
+		return ErrInvalidKeyLength
+	}
+	msg := signedPreKeyMessage(bundle.CurveParam, bundle.SignedPreKeyID, bundle.SignedPreKey)
+	if !ed25519.Verify(bundle.IdentitySigningKey, msg, bundle.SignedPreKeySignature) {
+		return ErrInvalidSignature
+	}
+	if len(bundle.PQPreKey) > 0 {
+		msg = pqPreKeyMessage(bundle.KEM, bundle.PQPreKeyID, bundle.PQPreKey)
+		if !ed25519.Verify(bundle.IdentitySigningKey, msg, bundle.PQPreKeySignature) {
+			return ErrInvalidSignature
+		}
+	}
+	return nil
+}
+
+//x3dhInitiatorSecret performs DH1..DH4 on the initiator side and returns the
+//concatenated key material together with the handshake message
+func x3dhInitiatorSecret(ik *IdentityKey, bundle *PreKeyBundle, randomData io.Reader) ([]byte, *X3DHMessage, error) {
+	if ik.CurveParam != bundle.CurveParam {
+		return nil, nil, ErrCurveMismatch
+	}
+	err := verifyPreKeyBundle(bundle)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := lookupCurve(ik.CurveParam)
+	if err != nil {
+		return nil, nil, err
+	}
+	ek, err := c.generate(randomData)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer zeroKey(ek.PrivateKey)
+
+	km := x3dhFiller(ik.CurveParam)
+	for _, dh := range []struct {
+		priv *ecdh.ECDH
+		pub  []byte
+	}{
+		{ik.DH, bundle.SignedPreKey},
+		{ek, bundle.IdentityKey},
+		{ek, bundle.SignedPreKey},
+	} {
+		secret, err := c.sharedSecret(dh.priv, dh.pub)
+		if err != nil {
+			return nil, nil, err
+		}
+		km = append(km, secret...)
+	}
+
+	msg := &X3DHMessage{
+		IdentityKey:    ik.DH.PublicKey,
+		EphemeralKey:   ek.PublicKey,
+		SignedPreKeyID: bundle.SignedPreKeyID,
+	}
+	if len(bundle.OneTimePreKey) > 0 {
+		secret, err := c.sharedSecret(ek, bundle.OneTimePreKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		km = append(km, secret...)
+		msg.HasOneTimePreKey = true
+		msg.OneTimePreKeyID = bundle.OneTimePreKeyID
+	}
+	return km, msg, nil
+}
+
+//x3dhResponderSecret performs DH1..DH4 on the responder side
+func x3dhResponderSecret(ik *IdentityKey, spk *SignedPreKey, opk *PreKey, msg *X3DHMessage) ([]byte, error) {
+	if msg.SignedPreKeyID != spk.ID {
+		return nil, ErrUnknownPreKey
+	}
+	if msg.HasOneTimePreKey && (opk == nil || opk.ID != msg.OneTimePreKeyID) {
+		return nil, ErrUnknownPreKey
+	}
+	c, err := lookupCurve(ik.CurveParam)
+	if err != nil {
+		return nil, err
+	}
+
+	km := x3dhFiller(ik.CurveParam)
+	for _, dh := range []struct {
+		priv *ecdh.ECDH
+		pub  []byte
+	}{
+		{spk.DH, msg.IdentityKey},
+		{ik.DH, msg.EphemeralKey},
+		{spk.DH, msg.EphemeralKey},
+	} {
+		secret, err := c.sharedSecret(dh.priv, dh.pub)
+		if err != nil {
+			return nil, err
+		}
+		km = append(km, secret...)
+	}
+	if msg.HasOneTimePreKey {
+		secret, err := c.sharedSecret(opk.DH, msg.EphemeralKey)
+		if err != nil {
+			return nil, err
+		}
+		km = append(km, secret...)
+	}
+	return km, nil
+}
+
+func x3dhInitiate(ik *IdentityKey, bundle *PreKeyBundle, streamCipher, HKDF, HMAC uint8, randomData io.Reader) (*State, *X3DHMessage, error) {
+	km, msg, err := x3dhInitiatorSecret(ik, bundle, randomData)
+	if err != nil {
+		return nil, nil, err
+	}
+	masterKey, err := x3dhDeriveMasterKey(HKDF, km, x3dhInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer zeroKey(masterKey)
+	s, err := axolotlNewS(ik.CurveParam, streamCipher, HKDF, HMAC, masterKey, bundle.SignedPreKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.random = randomData
+	return s, msg, nil
+}
+
+func pqxdhInitiate(ik *IdentityKey, bundle *PreKeyBundle, streamCipher, HKDF, HMAC uint8, randomData io.Reader) (*State, *X3DHMessage, error) {
+	if len(bundle.PQPreKey) == 0 {
+		return nil, nil, ErrMissingPQPreKey
+	}
+	k, ok := kems[bundle.KEM]
+	if !ok {
+		return nil, nil, ErrUnknownKEM
+	}
+	km, msg, err := x3dhInitiatorSecret(ik, bundle, randomData)
+	if err != nil {
+		return nil, nil, err
+	}
+	ss, ct, err := k.encapsulate(bundle.PQPreKey, randomData)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg.PQPreKeyID = bundle.PQPreKeyID
+	msg.KEMCiphertext = ct
+	masterKey, err := x3dhDeriveMasterKey(HKDF, append(km, ss...), pqxdhInfo)
+	zeroKey(ss)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer zeroKey(masterKey)
+	s, err := axolotlNewS(ik.CurveParam, streamCipher, HKDF, HMAC, masterKey, bundle.SignedPreKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.random = randomData
+	return s, msg, nil
+}
+
+func pqxdhRespond(ik *IdentityKey, spk *SignedPreKey, pqpk *PQPreKey, opk *PreKey, msg *X3DHMessage, streamCipher, HKDF, HMAC uint8, randomData io.Reader) (*State, error) {
+	if pqpk == nil || len(msg.KEMCiphertext) == 0 {
+		return nil, ErrMissingPQPreKey
+	}
+	if pqpk.ID != msg.PQPreKeyID {
+		return nil, ErrUnknownPreKey
+	}
+	k, ok := kems[pqpk.KEM]
+	if !ok {
+		return nil, ErrUnknownKEM
+	}
+	km, err := x3dhResponderSecret(ik, spk, opk, msg)
+	if err != nil {
+		return nil, err
+	}
+	ss, err := k.decapsulate(pqpk.DecapsulationKey, msg.KEMCiphertext)
+	if err != nil {
+		return nil, ErrMalformedMessage
+	}
+	masterKey, err := x3dhDeriveMasterKey(HKDF, append(km, ss...), pqxdhInfo)
+	zeroKey(ss)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroKey(masterKey)
+	s, err := axolotlNewR(ik.CurveParam, streamCipher, HKDF, HMAC, masterKey, copyKeyPair(spk.DH))
+	if err != nil {
+		return nil, err
+	}
+	s.random = randomData
+	return s, nil
+}
+
+func x3dhRespond(ik *IdentityKey, spk *SignedPreKey, opk *PreKey, msg *X3DHMessage, streamCipher, HKDF, HMAC uint8, randomData io.Reader) (*State, error) {
+	km, err := x3dhResponderSecret(ik, spk, opk, msg)
+	if err != nil {
+		return nil, err
+	}
+	masterKey, err := x3dhDeriveMasterKey(HKDF, km, x3dhInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroKey(masterKey)
+	s, err := axolotlNewR(ik.CurveParam, streamCipher, HKDF, HMAC, masterKey, copyKeyPair(spk.DH))
+	if err != nil {
+		return nil, err
+	}
+	s.random = randomData
+	return s, nil
+}
+
+//copyKeyPair copies a key pair, the ratchet zeroes its private key after the
+//first DH ratchet step which must not destroy the long lived signed prekey
+func copyKeyPair(p *ecdh.ECDH) *ecdh.ECDH {
+	return &ecdh.ECDH{
+		Curve:      p.Curve,
+		PrivateKey: append([]byte(nil), p.PrivateKey...),
+		PublicKey:  append([]byte(nil), p.PublicKey...),
+	}
+}
+
+func x3dhAssociatedData(initiatorIdentityKey, responderIdentityKey []byte) []byte {
+	ad := make([]byte, 0, len(initiatorIdentityKey)+len(responderIdentityKey))
+	ad = append(ad, initiatorIdentityKey...)
+	return append(ad, responderIdentityKey...)
+}
+
+func appendField(b, v []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+	return append(b, v...)
+}
+
+func readField(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, ErrMalformedMessage
+	}
+	n := int(binary.BigEndian.Uint16(b[0:2]))
+	if len(b) < 2+n {
+		return nil, nil, ErrMalformedMessage
+	}
+	return append([]byte(nil), b[2:2+n]...), b[2+n:], nil
+}
+
+func serializePreKeyBundle(bundle *PreKeyBundle) []byte {
+	b := []byte{bundle.CurveParam}
+	b = appendField(b, bundle.IdentityKey)
+	b = appendField(b, bundle.IdentitySigningKey)
+	b = binary.BigEndian.AppendUint32(b, bundle.SignedPreKeyID)
+	b = appendField(b, bundle.SignedPreKey)
+	b = appendField(b, bundle.SignedPreKeySignature)
+	b = binary.BigEndian.AppendUint32(b, bundle.OneTimePreKeyID)
+	b = appendField(b, bundle.OneTimePreKey)
+	if len(bundle.PQPreKey) == 0 {
+		return b
+	}
+	b = append(b, bundle.KEM)
+	b = binary.BigEndian.AppendUint32(b, bundle.PQPreKeyID)
+	b = appendField(b, bundle.PQPreKey)
+	return appendField(b, bundle.PQPreKeySignature)
+}
+
+func deserializePreKeyBundle(b []byte) (*PreKeyBundle, error) {
+	var err error
+	if len(b) < 1 {
+		return nil, ErrMalformedMessage
+	}
+	bundle := &PreKeyBundle{CurveParam: b[0]}
+	b = b[1:]
+	if bundle.IdentityKey, b, err = readField(b); err != nil {
+		return nil, err
+	}
+	var sk []byte
+	if sk, b, err = readField(b); err != nil {
+		return nil, err
+	}
+	bundle.IdentitySigningKey = ed25519.PublicKey(sk)
+	if len(b) < 4 {
+		return nil, ErrMalformedMessage
+	}
+	bundle.SignedPreKeyID = binary.BigEndian.Uint32(b[0:4])
+	if bundle.SignedPreKey, b, err = readField(b[4:]); err != nil {
+		return nil, err
+	}
+	if bundle.SignedPreKeySignature, b, err = readField(b); err != nil {
+		return nil, err
+	}
+	if len(b) < 4 {
+		return nil, ErrMalformedMessage
+	}
+	bundle.OneTimePreKeyID = binary.BigEndian.Uint32(b[0:4])
+	if bundle.OneTimePreKey, b, err = readField(b[4:]); err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return bundle, nil
+	}
+	if len(b) < 5 {
+		return nil, ErrMalformedMessage
+	}
+	bundle.KEM = b[0]
+	bundle.PQPreKeyID = binary.BigEndian.Uint32(b[1:5])
+	if bundle.PQPreKey, b, err = readField(b[5:]); err != nil {
+		return nil, err
+	}
+	if bundle.PQPreKeySignature, _, err = readField(b); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+func serializeX3DHMessage(msg *X3DHMessage) []byte {
+	b := appendField(nil, msg.IdentityKey)
+	b = appendField(b, msg.EphemeralKey)
+	b = binary.BigEndian.AppendUint32(b, msg.SignedPreKeyID)
+	if msg.HasOneTimePreKey {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+	b = binary.BigEndian.AppendUint32(b, msg.OneTimePreKeyID)
+	if len(msg.KEMCiphertext) == 0 {
+		return b
+	}
+	b = binary.BigEndian.AppendUint32(b, msg.PQPreKeyID)
+	return appendField(b, msg.KEMCiphertext)
+}
+
+func deserializeX3DHMessage(b []byte) (*X3DHMessage, error) {
+	var err error
+	msg := &X3DHMessage{}
+	if msg.IdentityKey, b, err = readField(b); err != nil {
+		return nil, err
+	}
+	if msg.EphemeralKey, b, err = readField(b); err != nil {
+		return nil, err
+	}
+	if len(b) < 9 {
+		return nil, ErrMalformedMessage
+	}
+	msg.SignedPreKeyID = binary.BigEndian.Uint32(b[0:4])
+	msg.HasOneTimePreKey = b[4] != 0
+	msg.OneTimePreKeyID = binary.BigEndian.Uint32(b[5:9])
+	b = b[9:]
+	if len(b) == 0 {
+		return msg, nil
+	}
+	if len(b) < 4 {
+		return nil, ErrMalformedMessage
+	}
+	msg.PQPreKeyID = binary.BigEndian.Uint32(b[0:4])
+	if msg.KEMCiphertext, _, err = readField(b[4:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
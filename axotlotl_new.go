@@ -1,29 +1,39 @@
 package axolotl
 
 import (
-	"container/list"
 	"github.com/arcpop/ecdh"
 	"io"
 )
 
+//minMasterKeyLength is the minimum length of the secret shared by both parties
+const minMasterKeyLength = 32
+
 func axolotlNewS(curveParam, streamCipher, HKDF, HMAC uint8, masterKey, dhPubKey []byte) (*State, error) {
 	state := &State{
 		CurveParam:   curveParam,
 		StreamCipher: streamCipher,
 		HKDF:         HKDF, HMAC: HMAC,
-		dhParams:     &ecdh.ECDH{Curve: dhCurves[curveParam]()},
-		dhPublicKey:  dhPubKey,
-		streamCipher: streamCiphers[streamCipher],
-		hkdf:         hkdfs[HKDF],
-		hmac:         hmacs[HMAC],
-		SenderSide:   true,
-		ratchetFlag:  true,
-		skippedKeys:  list.New(),
+		dhPublicKey: dhPubKey,
+		SenderSide:  true,
+		ratchetFlag: true,
+		skippedKeys: NewMemorySkippedKeyStore(),
+		Limits:      DefaultLimits,
+	}
+	err := initAlgorithms(state)
+	if err != nil {
+		return nil, err
+	}
+	if len(masterKey) < minMasterKeyLength {
+		return nil, ErrInvalidKeyLength
+	}
+	if len(dhPubKey) == 0 {
+		return nil, ErrInvalidPublicKey
 	}
+	state.dhParams = &ecdh.ECDH{Curve: state.dh.curve}
 	kdf := state.hkdf(masterKey, []byte{}, []byte{})
 
 	state.rootKey = make([]byte, 32)
-	_, err := io.ReadFull(kdf, state.rootKey)
+	_, err = io.ReadFull(kdf, state.rootKey)
 	if err != nil {
 		return nil, err
 	}
@@ -40,19 +50,27 @@ func axolotlNewR(curveParam, streamCipher, HKDF, HMAC uint8, masterKey []byte, e
 		CurveParam:   curveParam,
 		StreamCipher: streamCipher,
 		HKDF:         HKDF, HMAC: HMAC,
-		dhParams:     ecdhParams,
-		dhPublicKey:  nil,
-		streamCipher: streamCiphers[streamCipher],
-		hkdf:         hkdfs[HKDF],
-		hmac:         hmacs[HMAC],
-		SenderSide:   false,
-		ratchetFlag:  false,
-		skippedKeys:  list.New(),
+		dhParams:    ecdhParams,
+		dhPublicKey: nil,
+		SenderSide:  false,
+		ratchetFlag: false,
+		skippedKeys: NewMemorySkippedKeyStore(),
+		Limits:      DefaultLimits,
+	}
+	err := initAlgorithms(state)
+	if err != nil {
+		return nil, err
+	}
+	if len(masterKey) < minMasterKeyLength {
+		return nil, ErrInvalidKeyLength
+	}
+	if ecdhParams == nil || len(ecdhParams.PrivateKey) == 0 || len(ecdhParams.PublicKey) == 0 {
+		return nil, ErrInvalidKeyPair
 	}
 	kdf := state.hkdf(masterKey, []byte{}, []byte{})
 
 	state.rootKey = make([]byte, 32)
-	_, err := io.ReadFull(kdf, state.rootKey)
+	_, err = io.ReadFull(kdf, state.rootKey)
 	if err != nil {
 		return nil, err
 	}
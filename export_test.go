@@ -0,0 +1,39 @@
+package axolotl
+
+//UnregisterCipher removes a cipher added by RegisterCipher
+func UnregisterCipher(id uint8) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	delete(cipherNames.byName, cipherNames.byID[id])
+	delete(cipherNames.byID, id)
+	delete(streamCiphers, id)
+}
+
+//UnregisterCurve removes a curve added by RegisterCurve
+func UnregisterCurve(id uint8) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	delete(curveNames.byName, curveNames.byID[id])
+	delete(curveNames.byID, id)
+	delete(dhCurves, id)
+}
+
+//UnregisterSuite removes a suite added by RegisterSuite
+func UnregisterSuite(id uint16) {
+	suiteLock.Lock()
+	defer suiteLock.Unlock()
+	delete(suitesByName, suitesByID[id].Name)
+	delete(suitesByID, id)
+}
+
+//InSession reports whether the state is wrapped by a Session
+func (s *State) InSession() bool {
+	return s.rootLock != nil
+}
+
+//Locks returns the number of addresses the manager holds a lock for
+func (m *SessionManager) Locks() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.locks)
+}